@@ -0,0 +1,321 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"go.uber.org/zap"
+	"strings"
+)
+
+var (
+	// Returned by a MechanismExchange when the client's response could not
+	// be parsed.
+	ErrAuthMalformed = errors.New("smtp: malformed authentication response")
+
+	// Returned by a MechanismExchange, an Authenticator or a credential store
+	// when the client's credentials are not valid or the user is unknown.
+	ErrAuthFailed = errors.New("smtp: authentication failed")
+)
+
+// A server-side SASL mechanism for the AUTH command (RFC 4954). Register
+// mechanisms in Config.Mechanisms.
+type Mechanism interface {
+	// Name of the mechanism as advertised, such as "PLAIN".
+	Name() string
+
+	// Whether the mechanism can be offered in the session, for example only
+	// over TLS.
+	Available(sess *Session) bool
+
+	// Start a new authentication exchange in the session.
+	Start(ctx context.Context, sess *Session) MechanismExchange
+}
+
+// A single authentication exchange of a Mechanism, driven by the session's
+// dialog with the client.
+type MechanismExchange interface {
+	// Advance the exchange with the client's decoded response, which is nil
+	// on the first call if the client did not send an initial response.
+	// Return the next challenge to send to the client, or done with the
+	// identity the client has authenticated as. Return ErrAuthMalformed or
+	// ErrAuthFailed to fail the authentication, any other error fails it
+	// temporarily.
+	Next(ctx context.Context, response []byte) (challenge []byte, done bool, identity string, err error)
+}
+
+// Creates the PLAIN mechanism (RFC 4616), verifying the credentials with the
+// authenticator. The identity is the authorization identity requested by the
+// client, empty if it wishes to act as the username.
+func NewPlainMechanism(authenticator func(ctx context.Context, sess *Session, identity, username, password string) (bool, error)) Mechanism {
+	return &plainMechanism{
+		authenticator: authenticator,
+	}
+}
+
+type plainMechanism struct {
+	authenticator func(ctx context.Context, sess *Session, identity, username, password string) (bool, error)
+}
+
+func (mech *plainMechanism) Name() string {
+	return "PLAIN"
+}
+
+func (mech *plainMechanism) Available(sess *Session) bool {
+	return true
+}
+
+func (mech *plainMechanism) Start(ctx context.Context, sess *Session) MechanismExchange {
+	return &plainExchange{
+		mech: mech,
+		sess: sess,
+	}
+}
+
+type plainExchange struct {
+	mech *plainMechanism
+	sess *Session
+}
+
+func (exch *plainExchange) Next(ctx context.Context, response []byte) ([]byte, bool, string, error) {
+	if nil == response {
+		return []byte{}, false, "", nil
+	}
+
+	// [authzid] NUL authcid NUL passwd, RFC 4616
+	parts := bytes.Split(response, []byte{0})
+	if 3 != len(parts) || 0 == len(parts[1]) || 0 == len(parts[2]) {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	identity := string(parts[0])
+	username := string(parts[1])
+
+	ok, err := exch.mech.authenticator(ctx, exch.sess, identity, username, string(parts[2]))
+	if nil != err {
+		return nil, false, "", err
+	}
+
+	if !ok {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	if "" == identity {
+		identity = username
+	}
+
+	return nil, true, identity, nil
+}
+
+// Creates the LOGIN mechanism, verifying the credentials with the
+// authenticator. The identity passed to the authenticator is always empty.
+func NewLoginMechanism(authenticator func(ctx context.Context, sess *Session, identity, username, password string) (bool, error)) Mechanism {
+	return &loginMechanism{
+		authenticator: authenticator,
+	}
+}
+
+type loginMechanism struct {
+	authenticator func(ctx context.Context, sess *Session, identity, username, password string) (bool, error)
+}
+
+func (mech *loginMechanism) Name() string {
+	return "LOGIN"
+}
+
+func (mech *loginMechanism) Available(sess *Session) bool {
+	return true
+}
+
+func (mech *loginMechanism) Start(ctx context.Context, sess *Session) MechanismExchange {
+	return &loginExchange{
+		mech: mech,
+		sess: sess,
+	}
+}
+
+type loginExchange struct {
+	mech *loginMechanism
+	sess *Session
+
+	username []byte
+	started  bool
+}
+
+var (
+	challengeLoginUsername = []byte("Username:")
+	challengeLoginPassword = []byte("Password:")
+)
+
+func (exch *loginExchange) Next(ctx context.Context, response []byte) ([]byte, bool, string, error) {
+	if !exch.started {
+		exch.started = true
+
+		if nil == response {
+			return challengeLoginUsername, false, "", nil
+		}
+	}
+
+	if nil == exch.username {
+		if 0 == len(response) {
+			return nil, false, "", ErrAuthMalformed
+		}
+
+		exch.username = response
+
+		return challengeLoginPassword, false, "", nil
+	}
+
+	username := string(exch.username)
+
+	ok, err := exch.mech.authenticator(ctx, exch.sess, "", username, string(response))
+	if nil != err {
+		return nil, false, "", err
+	}
+
+	if !ok {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	return nil, true, username, nil
+}
+
+// Mechanisms available for the session, in the order they are advertised.
+func (sess *Session) mechanisms() []Mechanism {
+	if !sess.state.tls && !sess.config.insecureAuth {
+		return nil
+	}
+
+	mechanisms := make([]Mechanism, 0, len(sess.config.mechanisms))
+
+	for _, mech := range sess.config.mechanisms {
+		if mech.Available(sess) {
+			mechanisms = append(mechanisms, mech)
+		}
+	}
+
+	return mechanisms
+}
+
+var extensionAUTH = &builtinExtension{
+	advertise: func(sess *Session) string {
+		mechanisms := sess.mechanisms()
+
+		if 0 == len(mechanisms) {
+			return ""
+		}
+
+		names := make([]string, len(mechanisms))
+
+		for i, mech := range mechanisms {
+			names[i] = mech.Name()
+		}
+
+		return "AUTH " + strings.Join(names, " ")
+	},
+	mailParams: []string{"AUTH"},
+}
+
+func (sess *Session) processAUTH(ctx context.Context, command command) (Reply, sessionAction, error) {
+	if 0 == len(sess.config.mechanisms) {
+		return replyAnyNotImplemented, keepSession, nil
+	}
+
+	if 0 == len(sess.mechanisms()) {
+		return replyAUTHEncryptionRequired, keepSession, nil
+	}
+
+	if !sess.state.inEHLO() || "" != sess.state.identity || nil != sess.state.env {
+		return replyAnyBadSequence, keepSession, nil
+	}
+
+	if "" == command.mechanism {
+		return replyAnyBadParams, keepSession, nil
+	}
+
+	var mech Mechanism = nil
+
+	for _, candidate := range sess.mechanisms() {
+		if strings.EqualFold(candidate.Name(), command.mechanism) {
+			mech = candidate
+			break
+		}
+	}
+
+	if nil == mech {
+		return replyAUTHUnrecognizedMechanism, keepSession, nil
+	}
+
+	var response []byte = nil
+
+	if nil != command.initialResponse {
+		if "=" != string(command.initialResponse) {
+			decoded, err := base64.StdEncoding.DecodeString(string(command.initialResponse))
+			if nil != err {
+				return replyAUTHMalformed, keepSession, nil
+			}
+
+			response = decoded
+		} else {
+			response = []byte{}
+		}
+	}
+
+	sess.state.auth = mech.Start(ctx, sess)
+
+	return sess.advanceAUTH(ctx, response)
+}
+
+func (sess *Session) processAUTHResponse(ctx context.Context, line []byte) (Reply, sessionAction, error) {
+	line = bytes.TrimSuffix(line, crlf)
+
+	if "*" == string(line) {
+		sess.state.auth = nil
+
+		return replyAUTHCancelled, keepSession, nil
+	}
+
+	response, err := base64.StdEncoding.DecodeString(string(line))
+	if nil != err {
+		sess.state.auth = nil
+
+		return replyAUTHMalformed, keepSession, nil
+	}
+
+	return sess.advanceAUTH(ctx, response)
+}
+
+func (sess *Session) advanceAUTH(ctx context.Context, response []byte) (Reply, sessionAction, error) {
+	challenge, done, identity, err := sess.state.auth.Next(ctx, response)
+
+	if nil == err && !done {
+		return replyAUTHChallenge(challenge), keepSession, nil
+	}
+
+	sess.state.auth = nil
+
+	switch err {
+	case nil:
+		break
+
+	case ErrAuthMalformed:
+		return replyAUTHMalformed, keepSession, nil
+
+	case ErrAuthFailed:
+		sess.config.logger.Info("authentication failed")
+
+		return replyAUTHFailed, keepSession, nil
+
+	default:
+		sess.config.logger.Warn("authentication failed", zap.Error(err))
+
+		return replyAUTHTemporaryFailure, keepSession, nil
+	}
+
+	sess.config.logger.Info("authenticated", zap.String("identity", identity))
+
+	sess.state.identity = identity
+
+	return replyAUTHSucceeded, keepSession, nil
+}
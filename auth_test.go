@@ -0,0 +1,263 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"go.uber.org/zap"
+	tst "testing"
+)
+
+func testAuthenticator(ctx context.Context, sess *Session, identity, username, password string) (bool, error) {
+	if "broken" == username {
+		return false, errors.New("broken")
+	}
+
+	return "someone" == username && "secret" == password && ("" == identity || "someone" == identity), nil
+}
+
+func testBase64(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+func TestAuth(t *tst.T) {
+	examples := []struct {
+		Lines    []string
+		Expected []string
+		Identity string
+	}{
+		{
+			Lines: []string{
+				"EHLO domain.com",
+				"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+			},
+			Expected: []string{
+				"250-example.com greetings",
+				"250-8BITMIME",
+				"250-SIZE",
+				"250-PIPELINING",
+				"250-CHUNKING",
+				"250-BINARYMIME",
+				"250-SMTPUTF8",
+				"250-DSN",
+				"250-ENHANCEDSTATUSCODES",
+				"250 AUTH PLAIN LOGIN",
+				"235 2.7.0 Authentication successful",
+			},
+			Identity: "someone",
+		},
+		{
+			Lines: []string{
+				"HELO domain.com",
+				"auth plain",
+				testBase64("someone\x00someone\x00secret"),
+				"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+			},
+			Expected: []string{
+				"250 example.com greetings",
+				"334 ",
+				"235 2.7.0 Authentication successful",
+				"503 5.5.1 Bad sequence of commands",
+			},
+			Identity: "someone",
+		},
+		{
+			Lines: []string{
+				"HELO domain.com",
+				"AUTH LOGIN",
+				testBase64("someone"),
+				testBase64("secret"),
+			},
+			Expected: []string{
+				"250 example.com greetings",
+				"334 " + testBase64("Username:"),
+				"334 " + testBase64("Password:"),
+				"235 2.7.0 Authentication successful",
+			},
+			Identity: "someone",
+		},
+		{
+			Lines: []string{
+				"HELO domain.com",
+				"AUTH LOGIN " + testBase64("someone"),
+				testBase64("wrong"),
+				"AUTH PLAIN " + testBase64("other\x00someone\x00secret"),
+				"AUTH PLAIN " + testBase64("\x00broken\x00secret"),
+			},
+			Expected: []string{
+				"250 example.com greetings",
+				"334 " + testBase64("Password:"),
+				"535 5.7.8 Authentication credentials invalid",
+				"535 5.7.8 Authentication credentials invalid",
+				"454 4.7.0 Temporary authentication failure",
+			},
+		},
+		{
+			Lines: []string{
+				"AUTH PLAIN",
+				"HELO domain.com",
+				"AUTH",
+				"AUTH CRAM-MD5",
+				"AUTH PLAIN ???",
+				"AUTH PLAIN =",
+				"AUTH PLAIN " + testBase64("someone\x00secret"),
+				"AUTH LOGIN",
+				"*",
+				"AUTH LOGIN",
+				"!!!",
+				"NOOP",
+			},
+			Expected: []string{
+				"503 5.5.1 Bad sequence of commands",
+				"250 example.com greetings",
+				"501 5.5.4 Syntax error in parameters or arguments",
+				"504 5.5.4 Unrecognized authentication type",
+				"501 5.5.2 Cannot decode response",
+				"501 5.5.2 Cannot decode response",
+				"501 5.5.2 Cannot decode response",
+				"334 " + testBase64("Username:"),
+				"501 5.0.0 Authentication cancelled",
+				"334 " + testBase64("Username:"),
+				"501 5.5.2 Cannot decode response",
+				"250 2.0.0 Requested mail action okay, completed",
+			},
+		},
+	}
+
+	for _, ex := range examples {
+		identity := ""
+
+		server := NewServer(Config{
+			Domain:            "example.com",
+			Logger:            zap.NewExample(),
+			Authenticator:     testAuthenticator,
+			AllowInsecureAuth: true,
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				return &testEnvelope{}, nil
+			},
+		})
+
+		conn := testServerConn(ex.Lines...)
+
+		server.Accept(context.Background(), conn, func(ctx context.Context, srv *Server, sess *Session, init bool) {
+			if !init {
+				identity = sess.Identity()
+			}
+		})
+		server.Wait()
+
+		expected := "220 example.com Service ready\r\n"
+		for _, line := range ex.Expected {
+			expected += line + "\r\n"
+		}
+
+		if expected != conn.writer.String() {
+			t.Errorf("Unexpected output for %q: %v", ex.Lines, conn.writer.String())
+		}
+
+		if ex.Identity != identity {
+			t.Errorf("Unexpected identity for %q: %q", ex.Lines, identity)
+		}
+	}
+}
+
+func TestAuthRequiresTLS(t *tst.T) {
+	server := NewServer(Config{
+		Domain:        "example.com",
+		Logger:        zap.NewExample(),
+		Authenticator: testAuthenticator,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+		"MAIL FROM:<someone@domain.com> AUTH=someone",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"538 5.7.11 Encryption required for requested authentication mechanism",
+		"555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+}
+
+func TestAuthNotConfigured(t *tst.T) {
+	server := NewServer(Config{
+		Domain:            "example.com",
+		Logger:            zap.NewExample(),
+		AllowInsecureAuth: true,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"502 5.5.1 Command not implemented",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+}
+
+func TestAuthMailParam(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain:            "example.com",
+		Logger:            zap.NewExample(),
+		Authenticator:     testAuthenticator,
+		AllowInsecureAuth: true,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com> AUTH=other+2Bone@domain.com",
+		"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+		"RSET",
+		"AUTH PLAIN " + testBase64("\x00someone\x00secret"),
+		"MAIL FROM:<someone@domain.com> AUTH=<>",
+		"MAIL FROM:<someone@domain.com> AUTH=other+2bone@domain.com",
+		"MAIL FROM:<someone@domain.com> AUTH=other+2Bone@domain.com",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"503 5.5.1 Bad sequence of commands",
+		"250 2.0.0 Requested mail action okay, completed",
+		"235 2.7.0 Authentication successful",
+		"250 2.1.0 Requested mail action okay, completed",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 3 != len(envelope.mails) {
+		t.Fatalf("Unexpected number of MAIL calls: %v", len(envelope.mails))
+	}
+
+	for i, auth := range []string{"", "", "other+one@domain.com"} {
+		if auth != envelope.mails[i].Auth {
+			t.Errorf("Unexpected AUTH for MAIL %v: %q", i, envelope.mails[i].Auth)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var patternCommand = regexp.MustCompile("(?i)^([A-Z]+)(\r\n$| +\r\n$| +(.*) *\r\n$)")
@@ -19,25 +20,61 @@ const (
 type commandName = int
 
 const (
-	commandHELO     commandName = iota
-	commandEHLO                 = iota
-	commandRCPT                 = iota
-	commandMAIL                 = iota
-	commandDATA                 = iota
-	commandRSET                 = iota
-	commandQUIT                 = iota
-	commandEXPN                 = iota
-	commandVRFY                 = iota
-	commandHELP                 = iota
-	commandNOOP                 = iota
-	commandSTARTTLS             = iota
+	commandHELO      commandName = iota
+	commandEHLO                  = iota
+	commandRCPT                  = iota
+	commandMAIL                  = iota
+	commandDATA                  = iota
+	commandRSET                  = iota
+	commandQUIT                  = iota
+	commandEXPN                  = iota
+	commandVRFY                  = iota
+	commandHELP                  = iota
+	commandNOOP                  = iota
+	commandSTARTTLS              = iota
+	commandAUTH                  = iota
+	commandBDAT                  = iota
+	commandExtension             = iota
 )
 
 type command struct {
 	name commandName
 
+	// verb and arguments of commands not handled by a parser
+	verb string
+	args []byte
+
 	addr     []byte
+	path     Path
 	sizeHint uint64
+	body     BodyType
+	utf8     bool
+
+	ret       DSNReturn
+	envID     string
+	notify    DSNNotify
+	orcptType string
+	orcpt     string
+
+	params    Params
+	badParams bool
+
+	mechanism       string
+	initialResponse []byte
+
+	chunkSize uint64
+	last      bool
+}
+
+// Whether the client waits for the reply to this command before sending more
+// commands, so that it may be the last in a pipelined group, RFC 2920.
+func (cmd command) synchronizing() bool {
+	switch cmd.name {
+	case commandRCPT, commandMAIL, commandRSET, commandBDAT:
+		return false
+	}
+
+	return true
 }
 
 var commandParsers = map[string]func(args []byte) command{
@@ -53,6 +90,8 @@ var commandParsers = map[string]func(args []byte) command{
 	"HELP":     parseHELP,
 	"NOOP":     parseNOOP,
 	"STARTTLS": parseSTARTTLS,
+	"AUTH":     parseAUTH,
+	"BDAT":     parseBDAT,
 }
 
 func parseCommand(line []byte) (command, parseResult) {
@@ -64,12 +103,19 @@ func parseCommand(line []byte) (command, parseResult) {
 
 	name := string(bytes.ToUpper(parts[1]))
 
+	args := bytes.TrimSpace(parts[3])
+
 	parser := commandParsers[name]
 	if nil == parser {
-		return command{}, parseUnrecognizedCommand
-	}
+		cmd := command{
+			verb: name,
+			args: make([]byte, len(args)),
+		}
 
-	args := bytes.TrimSpace(parts[3])
+		copy(cmd.args, args)
+
+		return cmd, parseUnrecognizedCommand
+	}
 
 	return parser(args), parseOk
 }
@@ -101,44 +147,138 @@ func parseEHLO(args []byte) command {
 	}
 }
 
-var patternFROM = regexp.MustCompile("(?i)FROM:<([^>]+)>")
-var patternSIZE = regexp.MustCompile("(?i)SIZE=([1-9][0-9]*|0)")
+var patternSIZE = regexp.MustCompile("^([1-9][0-9]*|0)$")
+
+// Parses the path argument of MAIL or RCPT following the prefix, such as
+// "FROM:" or "TO:". Spaces after the prefix are tolerated, even though RFC
+// 5321 does not allow them.
+func parsePathArgument(args []byte, prefix string) (Path, []byte, []byte, bool) {
+	if len(args) < len(prefix) || !bytes.EqualFold([]byte(prefix), args[:len(prefix)]) {
+		return Path{}, nil, nil, false
+	}
+
+	path, addr, rest, ok := parsePath(bytes.TrimLeft(args[len(prefix):], " "))
+	if !ok || (len(rest) > 0 && ' ' != rest[0]) {
+		return Path{}, nil, nil, false
+	}
+
+	return path, addr, rest, true
+}
 
 func parseMAIL(args []byte) command {
 	cmd := command{
 		name: commandMAIL,
 	}
 
-	matches := patternFROM.FindSubmatch(args)
+	path, addr, rest, ok := parsePathArgument(args, "FROM:")
+
+	// the reverse-path may be null, used for delivery status notifications
+	if !ok || path.IsPostmaster() {
+		return cmd
+	}
+
+	cmd.path = path
+	cmd.addr = make([]byte, len(addr))
+	copy(cmd.addr, addr)
+
+	cmd.params, ok = parseParams(rest)
+	if !ok {
+		cmd.badParams = true
+		return cmd
+	}
+
+	if size, ok := cmd.params["SIZE"]; ok {
+		if !patternSIZE.MatchString(size) {
+			cmd.badParams = true
+			return cmd
+		}
+
+		sizeHint, err := strconv.ParseUint(size, 10, 64)
+		if nil != err {
+			cmd.badParams = true
+			return cmd
+		}
+
+		cmd.sizeHint = sizeHint
+	}
+
+	if value, ok := cmd.params["SMTPUTF8"]; ok {
+		if "" != value {
+			cmd.badParams = true
+			return cmd
+		}
+
+		cmd.utf8 = true
+	}
+
+	if ret, ok := cmd.params["RET"]; ok {
+		cmd.ret, ok = parseRET(ret)
+		if !ok {
+			cmd.badParams = true
+			return cmd
+		}
+	}
 
-	if nil != matches {
-		cmd.addr = make([]byte, len(matches[1]))
-		copy(cmd.addr, matches[1])
+	if envID, ok := cmd.params["ENVID"]; ok {
+		cmd.envID, ok = parseENVID(envID)
+		if !ok {
+			cmd.badParams = true
+			return cmd
+		}
 	}
 
-	matches = patternSIZE.FindSubmatch(args)
-	if nil != matches {
-		sizeHint, err := strconv.ParseUint(string(matches[1]), 10, 64)
-		if nil == err {
-			cmd.sizeHint = sizeHint
+	if body, ok := cmd.params["BODY"]; ok {
+		switch strings.ToUpper(body) {
+		case "7BIT":
+			cmd.body = Body7BIT
+		case "8BITMIME":
+			cmd.body = Body8BITMIME
+		case "BINARYMIME":
+			cmd.body = BodyBINARYMIME
+		default:
+			cmd.badParams = true
+			return cmd
 		}
 	}
 
 	return cmd
 }
 
-var patternTO = regexp.MustCompile("(?i)TO:<([^>]+)>")
-
 func parseRCPT(args []byte) command {
 	cmd := command{
 		name: commandRCPT,
 	}
 
-	matches := patternTO.FindSubmatch(args)
+	path, addr, rest, ok := parsePathArgument(args, "TO:")
+
+	if !ok || path.IsNull() {
+		return cmd
+	}
+
+	cmd.path = path
+	cmd.addr = make([]byte, len(addr))
+	copy(cmd.addr, addr)
+
+	cmd.params, ok = parseParams(rest)
+	if !ok {
+		cmd.badParams = true
+		return cmd
+	}
+
+	if notify, ok := cmd.params["NOTIFY"]; ok {
+		cmd.notify, ok = parseNOTIFY(notify)
+		if !ok {
+			cmd.badParams = true
+			return cmd
+		}
+	}
 
-	if nil != matches {
-		cmd.addr = make([]byte, len(matches[1]))
-		copy(cmd.addr, matches[1])
+	if orcpt, ok := cmd.params["ORCPT"]; ok {
+		cmd.orcptType, cmd.orcpt, ok = parseORCPT(orcpt)
+		if !ok {
+			cmd.badParams = true
+			return cmd
+		}
 	}
 
 	return cmd
@@ -191,3 +331,60 @@ func parseSTARTTLS(args []byte) command {
 		name: commandSTARTTLS,
 	}
 }
+
+func parseAUTH(args []byte) command {
+	cmd := command{
+		name: commandAUTH,
+	}
+
+	fields := bytes.Fields(args)
+
+	if len(fields) > 0 {
+		cmd.mechanism = string(bytes.ToUpper(fields[0]))
+	}
+
+	if len(fields) > 1 {
+		cmd.initialResponse = make([]byte, len(fields[1]))
+		copy(cmd.initialResponse, fields[1])
+	}
+
+	if len(fields) > 2 {
+		cmd.mechanism = ""
+	}
+
+	return cmd
+}
+
+var patternChunkSize = regexp.MustCompile("^[0-9]+$")
+
+func parseBDAT(args []byte) command {
+	cmd := command{
+		name: commandBDAT,
+	}
+
+	fields := bytes.Fields(args)
+
+	if 0 == len(fields) || len(fields) > 2 || !patternChunkSize.Match(fields[0]) {
+		cmd.badParams = true
+		return cmd
+	}
+
+	chunkSize, err := strconv.ParseUint(string(fields[0]), 10, 64)
+	if nil != err {
+		cmd.badParams = true
+		return cmd
+	}
+
+	if 2 == len(fields) {
+		if !bytes.EqualFold(fields[1], []byte("LAST")) {
+			cmd.badParams = true
+			return cmd
+		}
+
+		cmd.last = true
+	}
+
+	cmd.chunkSize = chunkSize
+
+	return cmd
+}
@@ -3,15 +3,20 @@ package smtp
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 	"strings"
 	tst "testing"
 )
 
 func TestParseCommand(t *tst.T) {
 	expected := map[string]struct {
-		name     commandName
-		addr     []byte
-		sizeHint uint64
+		name      commandName
+		addr      []byte
+		sizeHint  uint64
+		body      BodyType
+		utf8      bool
+		params    Params
+		badParams bool
 	}{
 		"HELO": {
 			name: commandHELO,
@@ -42,6 +47,9 @@ func TestParseCommand(t *tst.T) {
 			name: commandRCPT,
 			addr: []byte("someone@example.com"),
 		},
+		"RCPT TO:<>": {
+			name: commandRCPT,
+		},
 		"RCPT TO:someone@example.com": {
 			name: commandRCPT,
 		},
@@ -52,16 +60,24 @@ func TestParseCommand(t *tst.T) {
 			name: commandMAIL,
 			addr: []byte("someone@example.com"),
 		},
-		"MAIL FROM:someone@example.com": {
+		"MAIL FROM:<>": {
 			name: commandMAIL,
+			addr: []byte{},
 		},
-		"MAIL SIZE=123": {
+		"MAIL FROM:<> SIZE=123": {
 			name:     commandMAIL,
+			addr:     []byte{},
 			sizeHint: 123,
+			params:   Params{"SIZE": "123"},
+		},
+		"MAIL FROM:someone@example.com": {
+			name: commandMAIL,
+		},
+		"MAIL SIZE=123": {
+			name: commandMAIL,
 		},
 		"MAIL SIZE=0": {
-			name:     commandMAIL,
-			sizeHint: 0,
+			name: commandMAIL,
 		},
 		"MAIL SIZE:123": {
 			name: commandMAIL,
@@ -70,11 +86,95 @@ func TestParseCommand(t *tst.T) {
 			name:     commandMAIL,
 			addr:     []byte("someone@example.com"),
 			sizeHint: 123,
+			params:   Params{"SIZE": "123"},
 		},
 		"MAIL SIZE=123 FROM:<someone@example.com>": {
+			name: commandMAIL,
+		},
+		"MAIL FROM:<someone@example.com> SIZE=0": {
+			name:   commandMAIL,
+			addr:   []byte("someone@example.com"),
+			params: Params{"SIZE": "0"},
+		},
+		"MAIL FROM:<someone@example.com> SIZE=123 BODY=8BITMIME X-ONE": {
 			name:     commandMAIL,
 			addr:     []byte("someone@example.com"),
 			sizeHint: 123,
+			body:     Body8BITMIME,
+			params:   Params{"SIZE": "123", "BODY": "8BITMIME", "X-ONE": ""},
+		},
+		"MAIL FROM:<someone@example.com> BODY=BINARYMIME": {
+			name:   commandMAIL,
+			addr:   []byte("someone@example.com"),
+			body:   BodyBINARYMIME,
+			params: Params{"BODY": "BINARYMIME"},
+		},
+		"MAIL FROM:<someone@example.com> BODY=7BIT": {
+			name:   commandMAIL,
+			addr:   []byte("someone@example.com"),
+			params: Params{"BODY": "7BIT"},
+		},
+		"MAIL FROM:<someone@example.com> SMTPUTF8": {
+			name:   commandMAIL,
+			addr:   []byte("someone@example.com"),
+			utf8:   true,
+			params: Params{"SMTPUTF8": ""},
+		},
+		"MAIL FROM:<someone@example.com> SMTPUTF8=1": {
+			name:      commandMAIL,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"MAIL FROM:<someone@example.com> BODY=8BIT": {
+			name:      commandMAIL,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"MAIL FROM:<someone@example.com> SIZE=": {
+			name:      commandMAIL,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"MAIL FROM:<someone@example.com> SIZE=12a": {
+			name:      commandMAIL,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"MAIL FROM:<someone@example.com> SIZE=99999999999999999999999": {
+			name:      commandMAIL,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"RCPT TO:<someone@example.com> NOTIFY=NEVER": {
+			name:   commandRCPT,
+			addr:   []byte("someone@example.com"),
+			params: Params{"NOTIFY": "NEVER"},
+		},
+		"RCPT TO:<someone@example.com> -NOTIFY": {
+			name:      commandRCPT,
+			addr:      []byte("someone@example.com"),
+			badParams: true,
+		},
+		"MAIL FROM: <someone@example.com>": {
+			name: commandMAIL,
+			addr: []byte("someone@example.com"),
+		},
+		"MAIL FROM:<@a.com,@b.com:someone@example.com>": {
+			name: commandMAIL,
+			addr: []byte("someone@example.com"),
+		},
+		"MAIL FROM:<someone@example.com>SIZE=123": {
+			name: commandMAIL,
+		},
+		"MAIL FROM:<postmaster>": {
+			name: commandMAIL,
+		},
+		"RCPT TO:<postmaster>": {
+			name: commandRCPT,
+			addr: []byte("postmaster"),
+		},
+		"RCPT TO:<some one@example.com>": {
+			name: commandRCPT,
 		},
 		"DATA": {
 			name: commandDATA,
@@ -113,13 +213,35 @@ func TestParseCommand(t *tst.T) {
 				t.Errorf("Unexpected type for command %v: %v", cmd, parsed.name)
 			}
 
-			if !bytes.Equal(parsed.addr, s.addr) {
+			if !bytes.Equal(parsed.addr, s.addr) || (nil == parsed.addr) != (nil == s.addr) {
 				t.Errorf("Unexpected value for Addr %v: %v", cmd, parsed.addr)
 			}
 
 			if parsed.sizeHint != s.sizeHint {
 				t.Errorf("Unexpected value for SizeHint %v: %v", cmd, parsed.sizeHint)
 			}
+
+			if parsed.body != s.body {
+				t.Errorf("Unexpected value for body %v: %v", cmd, parsed.body)
+			}
+
+			if parsed.utf8 != s.utf8 {
+				t.Errorf("Unexpected value for utf8 %v: %v", cmd, parsed.utf8)
+			}
+
+			if parsed.badParams != s.badParams {
+				t.Errorf("Unexpected value for badParams %v: %v", cmd, parsed.badParams)
+			}
+
+			params := Params{}
+			for keyword, value := range s.params {
+				// the command line is lower-cased
+				params[keyword] = strings.ToLower(value)
+			}
+
+			if !s.badParams && (len(params) > 0 || len(parsed.params) > 0) && !reflect.DeepEqual(parsed.params, params) {
+				t.Errorf("Unexpected value for params %v: %v", cmd, parsed.params)
+			}
 		}
 	}
 }
@@ -149,3 +271,55 @@ func TestParseCommandBadFormat(t *tst.T) {
 		}
 	}
 }
+
+func TestCommandSynchronizing(t *tst.T) {
+	examples := map[string]bool{
+		"EHLO domain.com\r\n":                false,
+		"MAIL FROM:<someone@domain.com>\r\n": true,
+		"RCPT TO:<someone@domain.com>\r\n":   true,
+		"RSET\r\n":                           true,
+		"DATA\r\n":                           false,
+		"NOOP\r\n":                           false,
+		"AUTH PLAIN\r\n":                     false,
+		"STARTTLS\r\n":                       false,
+		"QUIT\r\n":                           false,
+	}
+
+	for line, pipelinable := range examples {
+		command, _ := parseCommand([]byte(line))
+
+		if pipelinable == command.synchronizing() {
+			t.Errorf("Unexpected synchronizing for %q", line)
+		}
+	}
+}
+
+func TestParseBDAT(t *tst.T) {
+	examples := map[string]struct {
+		chunkSize uint64
+		last      bool
+		badParams bool
+	}{
+		"BDAT 0":                       {0, false, false},
+		"BDAT 1024":                    {1024, false, false},
+		"BDAT 1024 LAST":               {1024, true, false},
+		"BDAT 0 last":                  {0, true, false},
+		"BDAT":                         {0, false, true},
+		"BDAT -1":                      {0, false, true},
+		"BDAT 1024 FIRST":              {0, false, true},
+		"BDAT 1024 LAST more":          {0, false, true},
+		"BDAT 99999999999999999999999": {0, false, true},
+	}
+
+	for line, ex := range examples {
+		cmd, result := parseCommand([]byte(line + "\r\n"))
+
+		if parseOk != result || commandBDAT != cmd.name {
+			t.Errorf("Unexpected parse result for %q: %v", line, result)
+		}
+
+		if ex.chunkSize != cmd.chunkSize || ex.last != cmd.last || ex.badParams != cmd.badParams {
+			t.Errorf("Unexpected BDAT for %q: %v %v %v", line, cmd.chunkSize, cmd.last, cmd.badParams)
+		}
+	}
+}
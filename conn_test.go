@@ -2,7 +2,15 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net"
+	tst "testing"
 	"time"
 )
 
@@ -84,3 +92,85 @@ func (addr *testAddr) Network() string {
 func (addr *testAddr) String() string {
 	return addr.address
 }
+
+type testListener struct {
+	addr net.Addr
+
+	acceptCalls int
+	closeCalls  int
+
+	onAccept func(listener *testListener) (net.Conn, error)
+	onClose  func(listener *testListener) error
+}
+
+func (listener *testListener) Accept() (net.Conn, error) {
+	listener.acceptCalls += 1
+
+	return listener.onAccept(listener)
+}
+
+func (listener *testListener) Close() error {
+	listener.closeCalls += 1
+
+	if nil != listener.onClose {
+		return listener.onClose(listener)
+	}
+
+	return nil
+}
+
+func (listener *testListener) Addr() net.Addr {
+	return listener.addr
+}
+
+type testNetError struct {
+	temporary bool
+}
+
+func (err *testNetError) Error() string {
+	return "test net error"
+}
+
+func (err *testNetError) Timeout() bool {
+	return false
+}
+
+func (err *testNetError) Temporary() bool {
+	return err.temporary
+}
+
+func testTLSConfig(t *tst.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatalf("Generating key failed: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "example.com",
+		},
+		DNSNames:  []string{"example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatalf("Creating certificate failed: %v", err)
+	}
+
+	return &tls.Config{
+		ServerName: "example.com",
+		Certificates: []tls.Certificate{
+			{
+				Certificate: [][]byte{der},
+				PrivateKey:  key,
+			},
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Creates the CRAM-MD5 mechanism (RFC 2195), looking up the plain text
+// password of users with the password callback. Return ErrAuthFailed from
+// the callback if the user is unknown.
+func NewCRAMMD5Mechanism(password func(ctx context.Context, sess *Session, username string) (string, error)) Mechanism {
+	return &cramMD5Mechanism{
+		password: password,
+	}
+}
+
+type cramMD5Mechanism struct {
+	password func(ctx context.Context, sess *Session, username string) (string, error)
+}
+
+func (mech *cramMD5Mechanism) Name() string {
+	return "CRAM-MD5"
+}
+
+func (mech *cramMD5Mechanism) Available(sess *Session) bool {
+	return true
+}
+
+func (mech *cramMD5Mechanism) Start(ctx context.Context, sess *Session) MechanismExchange {
+	return &cramMD5Exchange{
+		mech: mech,
+		sess: sess,
+	}
+}
+
+type cramMD5Exchange struct {
+	mech *cramMD5Mechanism
+	sess *Session
+
+	challenge []byte
+}
+
+func (exch *cramMD5Exchange) Next(ctx context.Context, response []byte) ([]byte, bool, string, error) {
+	if nil == exch.challenge {
+		if nil != response {
+			// CRAM-MD5 does not have an initial response
+			return nil, false, "", ErrAuthMalformed
+		}
+
+		exch.challenge = []byte("<" + generateID() + "." + strconv.FormatInt(time.Now().Unix(), 10) + "@" + exch.sess.config.domain + ">")
+
+		return exch.challenge, false, "", nil
+	}
+
+	// username SP digest
+	space := strings.LastIndexByte(string(response), ' ')
+	if space <= 0 {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	username := string(response[:space])
+
+	digest, err := hex.DecodeString(string(response[space+1:]))
+	if nil != err || md5.Size != len(digest) {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	password, err := exch.mech.password(ctx, exch.sess, username)
+	if nil != err {
+		return nil, false, "", err
+	}
+
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write(exch.challenge)
+
+	if 1 != subtle.ConstantTimeCompare(mac.Sum(nil), digest) {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	return nil, true, username, nil
+}
@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"go.uber.org/zap"
+	"strings"
+	tst "testing"
+)
+
+func testPassword(ctx context.Context, sess *Session, username string) (string, error) {
+	switch username {
+	case "someone":
+		return "secret", nil
+
+	case "broken":
+		return "", errors.New("broken")
+	}
+
+	return "", ErrAuthFailed
+}
+
+func TestCRAMMD5(t *tst.T) {
+	examples := []struct {
+		Username string
+		Password string
+		Expected string
+	}{
+		{"someone", "secret", "235 2.7.0 Authentication successful"},
+		{"someone", "wrong", "535 5.7.8 Authentication credentials invalid"},
+		{"other", "secret", "535 5.7.8 Authentication credentials invalid"},
+		{"broken", "secret", "454 4.7.0 Temporary authentication failure"},
+	}
+
+	for _, ex := range examples {
+		server := NewServer(Config{
+			Domain:            "example.com",
+			Logger:            zap.NewExample(),
+			AllowInsecureAuth: true,
+			Mechanisms: []Mechanism{
+				NewCRAMMD5Mechanism(testPassword),
+			},
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				return &testEnvelope{}, nil
+			},
+		})
+
+		conn, reader, _ := testServerDial(t, server)
+
+		testServerDialog(t, conn, reader, []string{
+			"", "220 example.com Service ready",
+			"EHLO domain.com", "250-example.com greetings",
+			"", "250-8BITMIME",
+			"", "250-SIZE",
+			"", "250-PIPELINING",
+			"", "250-CHUNKING",
+			"", "250-BINARYMIME",
+			"", "250-SMTPUTF8",
+			"", "250-DSN",
+			"", "250-ENHANCEDSTATUSCODES",
+			"", "250 AUTH CRAM-MD5",
+			"AUTH CRAM-MD5 " + testBase64("someone"), "501 5.5.2 Cannot decode response",
+		})
+
+		conn.Write([]byte("AUTH CRAM-MD5\r\n"))
+
+		line, _ := reader.ReadString('\n')
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "334 ")))
+
+		if nil != err || !strings.HasPrefix(string(challenge), "<") || !strings.HasSuffix(string(challenge), "@example.com>") {
+			t.Errorf("Unexpected challenge: %q", line)
+		}
+
+		mac := hmac.New(md5.New, []byte(ex.Password))
+		mac.Write(challenge)
+
+		testServerDialog(t, conn, reader, []string{
+			testBase64(ex.Username + " " + hex.EncodeToString(mac.Sum(nil))), ex.Expected,
+		})
+
+		conn.Close()
+		server.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,129 @@
+package smtp
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Content requested in delivery status notifications with the RET
+// parameter of MAIL, RFC 3461 section 4.3.
+type DSNReturn = int
+
+const (
+	// No RET parameter, the choice is left to the server.
+	ReturnUnspecified DSNReturn = iota
+
+	// RET=FULL, the full message should be returned.
+	ReturnFull = iota
+
+	// RET=HDRS, only the headers of the message should be returned.
+	ReturnHeaders = iota
+)
+
+// Conditions for delivery status notifications requested with the NOTIFY
+// parameter of RCPT, RFC 3461 section 4.1. No flags set means the parameter
+// was not sent.
+type DSNNotify = int
+
+const (
+	// NOTIFY=NEVER, no notifications should be sent.
+	NotifyNever DSNNotify = 1 << iota
+
+	// NOTIFY=SUCCESS, notify on successful delivery.
+	NotifySuccess = 1 << iota
+
+	// NOTIFY=FAILURE, notify on failed delivery.
+	NotifyFailure = 1 << iota
+
+	// NOTIFY=DELAY, notify on delayed delivery.
+	NotifyDelay = 1 << iota
+)
+
+var dsnNotifyKeywords = map[string]DSNNotify{
+	"NEVER":   NotifyNever,
+	"SUCCESS": NotifySuccess,
+	"FAILURE": NotifyFailure,
+	"DELAY":   NotifyDelay,
+}
+
+var extensionDSN = &builtinExtension{
+	advertise: func(sess *Session) string {
+		return "DSN"
+	},
+	mailParams: []string{"RET", "ENVID"},
+	rcptParams: []string{"NOTIFY", "ORCPT"},
+}
+
+func parseRET(value string) (DSNReturn, bool) {
+	switch strings.ToUpper(value) {
+	case "FULL":
+		return ReturnFull, true
+
+	case "HDRS":
+		return ReturnHeaders, true
+	}
+
+	return ReturnUnspecified, false
+}
+
+// Parses the xtext of ENVID, which must decode to at most 100 printable
+// ASCII characters.
+func parseENVID(value string) (string, bool) {
+	envID, ok := decodeXtext(value)
+	if !ok || "" == envID || len(envID) > 100 {
+		return "", false
+	}
+
+	for i := 0; i < len(envID); i += 1 {
+		if envID[i] < 32 || envID[i] > 126 {
+			return "", false
+		}
+	}
+
+	return envID, true
+}
+
+// Parses NOTIFY, either NEVER or a comma separated list of SUCCESS, FAILURE
+// and DELAY.
+func parseNOTIFY(value string) (DSNNotify, bool) {
+	notify := DSNNotify(0)
+
+	for _, keyword := range strings.Split(strings.ToUpper(value), ",") {
+		flag, ok := dsnNotifyKeywords[keyword]
+		if !ok || 0 != notify&flag {
+			return 0, false
+		}
+
+		notify |= flag
+	}
+
+	if 0 != notify&NotifyNever && NotifyNever != notify {
+		return 0, false
+	}
+
+	return notify, true
+}
+
+// Parses ORCPT, an address type and the xtext of the original recipient,
+// into the upper-cased address type and the decoded address.
+func parseORCPT(value string) (string, string, bool) {
+	semicolon := strings.IndexByte(value, ';')
+	if semicolon <= 0 || len(value) > 500 {
+		return "", "", false
+	}
+
+	addrType := value[:semicolon]
+
+	for i := 0; i < len(addrType); i += 1 {
+		if !isAtext(addrType[i]) || addrType[i] >= utf8.RuneSelf {
+			return "", "", false
+		}
+	}
+
+	addr, ok := decodeXtext(value[semicolon+1:])
+	if !ok || "" == addr {
+		return "", "", false
+	}
+
+	return strings.ToUpper(addrType), addr, true
+}
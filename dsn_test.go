@@ -0,0 +1,105 @@
+package smtp
+
+import (
+	tst "testing"
+)
+
+func TestParseRET(t *tst.T) {
+	examples := map[string]struct {
+		Return DSNReturn
+		OK     bool
+	}{
+		"FULL": {ReturnFull, true},
+		"hdrs": {ReturnHeaders, true},
+		"":     {ReturnUnspecified, false},
+		"BODY": {ReturnUnspecified, false},
+	}
+
+	for input, ex := range examples {
+		ret, ok := parseRET(input)
+
+		if ex.OK != ok || ex.Return != ret {
+			t.Errorf("Unexpected result for %q: %v %v", input, ret, ok)
+		}
+	}
+}
+
+func TestParseENVID(t *tst.T) {
+	examples := map[string]struct {
+		EnvelopeID string
+		OK         bool
+	}{
+		"QQ314159":  {"QQ314159", true},
+		"a+2Bb+3Dc": {"a+b=c", true},
+		"+0A":       {"", false},
+		"a+2":       {"", false},
+		"":          {"", false},
+	}
+
+	long := ""
+	for i := 0; i < 101; i += 1 {
+		long += "a"
+	}
+
+	examples[long] = struct {
+		EnvelopeID string
+		OK         bool
+	}{"", false}
+
+	for input, ex := range examples {
+		envID, ok := parseENVID(input)
+
+		if ex.OK != ok || ex.EnvelopeID != envID {
+			t.Errorf("Unexpected result for %q: %q %v", input, envID, ok)
+		}
+	}
+}
+
+func TestParseNOTIFY(t *tst.T) {
+	examples := map[string]struct {
+		Notify DSNNotify
+		OK     bool
+	}{
+		"NEVER":                 {NotifyNever, true},
+		"success":               {NotifySuccess, true},
+		"SUCCESS,FAILURE,DELAY": {NotifySuccess | NotifyFailure | NotifyDelay, true},
+		"FAILURE,DELAY":         {NotifyFailure | NotifyDelay, true},
+		"NEVER,FAILURE":         {0, false},
+		"FAILURE,FAILURE":       {0, false},
+		"FAILURE,":              {0, false},
+		"ALWAYS":                {0, false},
+	}
+
+	for input, ex := range examples {
+		notify, ok := parseNOTIFY(input)
+
+		if ex.OK != ok || ex.Notify != notify {
+			t.Errorf("Unexpected result for %q: %v %v", input, notify, ok)
+		}
+	}
+}
+
+func TestParseORCPT(t *tst.T) {
+	examples := map[string]struct {
+		Type string
+		Addr string
+		OK   bool
+	}{
+		"rfc822;someone@example.com":    {"RFC822", "someone@example.com", true},
+		"RFC822;some+2Bone@example.com": {"RFC822", "some+one@example.com", true},
+		"utf-8;j+C3+B6ran@example.com":  {"UTF-8", "j\xc3\xb6ran@example.com", true},
+		"someone@example.com":           {"", "", false},
+		";someone@example.com":          {"", "", false},
+		"rfc822;":                       {"", "", false},
+		"rfc 822;someone@example.com":   {"", "", false},
+		"rfc822;some+2bone@example.com": {"", "", false},
+	}
+
+	for input, ex := range examples {
+		addrType, addr, ok := parseORCPT(input)
+
+		if ex.OK != ok || ex.Type != addrType || ex.Addr != addr {
+			t.Errorf("Unexpected result for %q: %q %q %v", input, addrType, addr, ok)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package smtp
 
 import (
 	"context"
+	"errors"
+
+	"go.uber.org/zap"
 )
 
 type FromAction = int
@@ -46,36 +49,156 @@ const (
 	RejectCommitPermanentlyForSizeExceeded              = iota
 )
 
+// Body type declared with the BODY parameter of MAIL.
+type BodyType = int
+
+const (
+	// No BODY parameter or BODY=7BIT, RFC 6152.
+	Body7BIT BodyType = iota
+
+	// BODY=8BITMIME, RFC 6152.
+	Body8BITMIME = iota
+
+	// BODY=BINARYMIME, RFC 3030. The content can only be sent with BDAT.
+	BodyBINARYMIME = iota
+)
+
 // Describes a SMTP mail envelope.
+//
+// From, Size, To, Open and Commit can return a Reply or *Reply as the error,
+// possibly wrapped, for example "550 5.1.1 user@example.com does not exist"
+// or "451 4.7.1 greylisted, try again in 5 minutes". The reply is sent to the
+// client instead of the one for the returned action, which is then ignored,
+// and does not terminate the connection unless it is a 421 reply, RFC 5321
+// section 3.8. A 4xx or 5xx reply rejects the command, while a 2xx reply
+// accepts it. Replies with any other code are treated like any other error.
 type Envelope interface {
-	// Add the reverse path to the envelope. Returning an error will terminate
-	// the connection.
+	// Add the reverse path to the envelope. The null reverse-path (MAIL
+	// FROM:<>), used for bounces and other delivery status notifications, is
+	// passed as an empty but non-nil addr. Returning an error other than a
+	// Reply will terminate the connection.
 	From(ctx context.Context, addr []byte) (FromAction, error)
 
-	// Add a size hint to the envelope. Returning an error will terminate the
-	// connection. Size hint of 0 may mean an advertised data length of 0 or
-	// none advertised.
+	// Add a size hint to the envelope. Returning an error other than a Reply
+	// will terminate the connection. Size hint of 0 may mean an advertised
+	// data length of 0 or none advertised.
 	Size(ctx context.Context, size uint64) (SizeAction, error)
 
-	// Add a recipient to the envelope. Returning an error will terminate the
-	// connection.
+	// Add a recipient to the envelope. Returning an error other than a Reply
+	// will terminate the connection.
 	To(ctx context.Context, addr []byte) (ToAction, error)
 
 	// Open the envelope for writing data. Ideally report any errors from From,
 	// Size or To in this step, or from the context cancellation, as an error
-	// here does not terminate the connection.
+	// here does not terminate the connection. A positive Reply accepts the
+	// data but is not sent, as the client expects the usual continuation.
 	Open(ctx context.Context) (DataAction, error)
 
-	// Write a line to the envelope. Returning an error will terminate the
+	// Write a line to the envelope. Content sent with BDAT is instead written
+	// as received, in pieces of the chunks which need not end at a line. Not
+	// called for a StreamEnvelope. Returning an error will terminate the
 	// connection.
 	Write(ctx context.Context, line []byte) error
 
 	// Commit the data. If you accept the commit, the SMTP client expects the
 	// mail to be delivered. If you return an error the transaction will be
-	// cancelled.
+	// cancelled, unless it is a Reply, which ends the transaction like the
+	// returned actions do.
 	Commit(ctx context.Context) (CommitAction, error)
 
 	// Discard this envelope. Returning an error does not affect the
 	// connection.
 	Discard(ctx context.Context) error
 }
+
+// A MAIL command.
+type Mail struct {
+	// The reverse-path, the null reverse-path is reported by IsNull.
+	From Path
+
+	// All ESMTP parameters of the command, including those also interpreted
+	// by the server such as SIZE.
+	Params Params
+
+	// Body type declared with the BODY parameter.
+	Body BodyType
+
+	// Whether the SMTPUTF8 parameter was sent, so that the paths and headers
+	// of the message may contain UTF-8, RFC 6531.
+	UTF8 bool
+
+	// Content requested in delivery status notifications with the RET
+	// parameter, RFC 3461.
+	Return DSNReturn
+
+	// Decoded ENVID parameter, the envelope identifier to be included in
+	// delivery status notifications. Empty if the parameter was not sent.
+	EnvelopeID string
+
+	// Decoded AUTH parameter, the identity of the original submitter as
+	// reported by the client. Empty if the parameter was not sent, was "<>",
+	// or the client has not authenticated.
+	Auth string
+}
+
+// A RCPT command.
+type Rcpt struct {
+	// The forward-path.
+	To Path
+
+	// All ESMTP parameters of the command.
+	Params Params
+
+	// Conditions for delivery status notifications requested with the NOTIFY
+	// parameter, RFC 3461. Zero if the parameter was not sent.
+	Notify DSNNotify
+
+	// Upper-cased address type of the ORCPT parameter, such as "RFC822".
+	// Empty if the parameter was not sent.
+	OriginalRecipientType string
+
+	// Decoded address of the ORCPT parameter, the original recipient to be
+	// reported in delivery status notifications.
+	OriginalRecipient string
+}
+
+// An Envelope can optionally implement CommandEnvelope to receive the parsed
+// MAIL and RCPT commands. Mail and Rcpt are then called instead of From and
+// To, with the same semantics.
+type CommandEnvelope interface {
+	Envelope
+
+	// Add the reverse path to the envelope. Returning an error other than a
+	// Reply will terminate the connection.
+	Mail(ctx context.Context, mail Mail) (FromAction, error)
+
+	// Add a recipient to the envelope. Returning an error other than a Reply
+	// will terminate the connection.
+	Rcpt(ctx context.Context, rcpt Rcpt) (ToAction, error)
+}
+
+// The reply carried by an error returned from an Envelope method, either as a
+// Reply or a *Reply, if any. Only 2xx, 4xx and 5xx replies complete a command,
+// so any other code is logged and the error treated like any other.
+func envelopeReply(err error, logger *zap.Logger) (Reply, bool) {
+	var reply Reply
+	var replyPtr *Reply
+
+	if errors.As(err, &replyPtr) && nil != replyPtr {
+		reply = *replyPtr
+	} else if !errors.As(err, &reply) {
+		return Reply{}, false
+	}
+
+	if 0 == reply.Code {
+		return Reply{}, false
+	}
+
+	if reply.Code < 200 || reply.Code > 599 || 3 == reply.Code/100 {
+		logger.Warn("invalid reply code from envelope", zap.Int("code", reply.Code))
+
+		return Reply{}, false
+	}
+
+	return reply, true
+}
@@ -3,6 +3,11 @@ package smtp
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	tst "testing"
+
+	"go.uber.org/zap"
 )
 
 type testEnvelope struct {
@@ -119,3 +124,89 @@ func (env *testEnvelope) Discard(ctx context.Context) error {
 
 	return nil
 }
+
+type testCommandEnvelope struct {
+	testEnvelope
+
+	mails []Mail
+	rcpts []Rcpt
+
+	onMail func(ctx context.Context, env *testCommandEnvelope, mail Mail) (FromAction, error)
+	onRcpt func(ctx context.Context, env *testCommandEnvelope, rcpt Rcpt) (ToAction, error)
+}
+
+func (env *testCommandEnvelope) Mail(ctx context.Context, mail Mail) (FromAction, error) {
+	env.fromCalls += 1
+
+	if nil != env.onMail {
+		return env.onMail(ctx, env, mail)
+	}
+
+	env.mails = append(env.mails, mail)
+
+	return AcceptFROM, nil
+}
+
+func (env *testCommandEnvelope) Rcpt(ctx context.Context, rcpt Rcpt) (ToAction, error) {
+	env.toCalls += 1
+
+	if nil != env.onRcpt {
+		return env.onRcpt(ctx, env, rcpt)
+	}
+
+	env.rcpts = append(env.rcpts, rcpt)
+
+	return AcceptTO, nil
+}
+
+func TestEnvelopeReply(t *tst.T) {
+	reply := Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"no such user"}}
+
+	examples := []struct {
+		Err      error
+		Expected bool
+	}{
+		{nil, false},
+		{errors.New("failed"), false},
+		{reply, true},
+		{&reply, true},
+		{fmt.Errorf("lookup: %w", reply), true},
+		{fmt.Errorf("lookup: %w", &reply), true},
+		{(*Reply)(nil), false},
+		{Reply{}, false},
+	}
+
+	for _, ex := range examples {
+		result, ok := envelopeReply(ex.Err, zap.NewExample())
+
+		if ex.Expected != ok || (ok && reply.Error() != result.Error()) {
+			t.Errorf("Unexpected reply for %#v: %v %v", ex.Err, result, ok)
+		}
+	}
+}
+
+func TestEnvelopeReplyCode(t *tst.T) {
+	examples := map[int]bool{
+		-550: false,
+		99:   false,
+		199:  false,
+		200:  true,
+		250:  true,
+		299:  true,
+		354:  false,
+		421:  true,
+		451:  true,
+		550:  true,
+		599:  true,
+		600:  false,
+		1234: false,
+	}
+
+	for code, expected := range examples {
+		for _, err := range []error{Reply{Code: code}, &Reply{Code: code}} {
+			if _, ok := envelopeReply(err, zap.NewExample()); expected != ok {
+				t.Errorf("Unexpected acceptance of %d from %#v", code, err)
+			}
+		}
+	}
+}
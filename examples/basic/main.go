@@ -4,7 +4,6 @@ import (
 	"context"
 	"github.com/hf/smtp"
 	"go.uber.org/zap"
-	"net"
 )
 
 func main() {
@@ -23,19 +22,9 @@ func main() {
 		Logger: logger,
 	})
 
-	listener, err := net.Listen("tcp", ":2525")
-	if nil != err {
-		logger.Fatal("listen failed", zap.Error(err))
-	}
-
-	for {
-		conn, err := listener.Accept()
-		if nil != err {
-			logger.Error("accept failed", zap.Error(err))
-			break
-		}
-
-		server.Accept(ctx, conn, nil)
+	err := server.ListenAndServe(ctx, ":2525")
+	if smtp.ErrServerClosed != err {
+		logger.Error("serve failed", zap.Error(err))
 	}
 
 	server.Wait()
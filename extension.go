@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// A SMTP service extension, advertised in the reply to EHLO. Register
+// extensions in Config.Extensions.
+type Extension interface {
+	// The line advertised in the reply to EHLO for this session, i.e. the
+	// extension keyword followed by optional parameters, such as "SIZE 1000".
+	// Returning the empty string disables the extension for this session, in
+	// which case its parameters and verbs are not recognized either.
+	Advertise(sess *Session) string
+
+	// Keywords of the MAIL parameters handled by this extension.
+	MailParams() []string
+
+	// Keywords of the RCPT parameters handled by this extension.
+	RcptParams() []string
+}
+
+// An Extension that also implements VerbExtension adds new commands to the
+// session.
+type VerbExtension interface {
+	Extension
+
+	// Verbs of the commands handled by this extension.
+	Verbs() []string
+
+	// Handle a command with one of the verbs. The args are the rest of the
+	// command line, without the verb and the CRLF. Returning an error will
+	// terminate the connection.
+	Command(ctx context.Context, sess *Session, verb string, args string) (Reply, error)
+}
+
+type builtinExtension struct {
+	advertise  func(sess *Session) string
+	mailParams []string
+	rcptParams []string
+}
+
+func (ext *builtinExtension) Advertise(sess *Session) string {
+	return ext.advertise(sess)
+}
+
+func (ext *builtinExtension) MailParams() []string {
+	return ext.mailParams
+}
+
+func (ext *builtinExtension) RcptParams() []string {
+	return ext.rcptParams
+}
+
+var (
+	extension8BITMIME = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "8BITMIME"
+		},
+		mailParams: []string{"BODY"},
+	}
+
+	extensionSIZE = &builtinExtension{
+		advertise: func(sess *Session) string {
+			if 0 == sess.config.maxMessageSize {
+				return "SIZE"
+			}
+
+			return "SIZE " + strconv.FormatUint(sess.config.maxMessageSize, 10)
+		},
+		mailParams: []string{"SIZE"},
+	}
+
+	extensionPIPELINING = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "PIPELINING"
+		},
+	}
+
+	extensionCHUNKING = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "CHUNKING"
+		},
+	}
+
+	extensionBINARYMIME = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "BINARYMIME"
+		},
+	}
+
+	extensionSMTPUTF8 = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "SMTPUTF8"
+		},
+		mailParams: []string{"SMTPUTF8"},
+	}
+
+	extensionENHANCEDSTATUSCODES = &builtinExtension{
+		advertise: func(sess *Session) string {
+			return "ENHANCEDSTATUSCODES"
+		},
+	}
+
+	extensionSTARTTLS = &builtinExtension{
+		advertise: func(sess *Session) string {
+			if sess.state.tls || !sess.config.tls {
+				return ""
+			}
+
+			return "STARTTLS"
+		},
+	}
+)
+
+// Extensions built into the server, in the order they are advertised.
+func builtinExtensions() []Extension {
+	return []Extension{
+		extension8BITMIME,
+		extensionSIZE,
+		extensionPIPELINING,
+		extensionCHUNKING,
+		extensionBINARYMIME,
+		extensionSMTPUTF8,
+		extensionDSN,
+		extensionENHANCEDSTATUSCODES,
+		extensionSTARTTLS,
+		extensionAUTH,
+	}
+}
+
+// Lines advertised in the reply to EHLO.
+func (sess *Session) advertisedExtensions() []string {
+	lines := make([]string, 0, len(sess.config.extensions))
+
+	for _, ext := range sess.config.extensions {
+		line := ext.Advertise(sess)
+
+		if "" != line {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// Whether all parameters are recognized by an extension enabled for this
+// session.
+func (sess *Session) recognizedParams(params Params, claims func(ext Extension) []string) bool {
+	if 0 == len(params) {
+		return true
+	}
+
+	recognized := make(map[string]bool)
+
+	for _, ext := range sess.config.extensions {
+		if "" == ext.Advertise(sess) {
+			continue
+		}
+
+		for _, keyword := range claims(ext) {
+			recognized[strings.ToUpper(keyword)] = true
+		}
+	}
+
+	for keyword := range params {
+		if !recognized[keyword] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The extension enabled for this session that handles the verb, or nil.
+func (sess *Session) verbExtension(verb string) VerbExtension {
+	for _, ext := range sess.config.extensions {
+		verbExt, ok := ext.(VerbExtension)
+		if !ok {
+			continue
+		}
+
+		for _, extVerb := range verbExt.Verbs() {
+			if strings.EqualFold(verb, extVerb) && "" != ext.Advertise(sess) {
+				return verbExt
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package smtp
+
+import (
+	"context"
+	"go.uber.org/zap"
+	tst "testing"
+)
+
+type testExtension struct {
+	advertise string
+
+	commandCalls int
+
+	onCommand func(ctx context.Context, ext *testExtension, sess *Session, verb string, args string) (Reply, error)
+}
+
+func (ext *testExtension) Advertise(sess *Session) string {
+	if nil == sess.Domain() {
+		return ""
+	}
+
+	return ext.advertise
+}
+
+func (ext *testExtension) MailParams() []string {
+	return []string{"x-mail"}
+}
+
+func (ext *testExtension) RcptParams() []string {
+	return []string{"X-RCPT"}
+}
+
+func (ext *testExtension) Verbs() []string {
+	return []string{"XTEST"}
+}
+
+func (ext *testExtension) Command(ctx context.Context, sess *Session, verb string, args string) (Reply, error) {
+	ext.commandCalls += 1
+
+	if nil != ext.onCommand {
+		return ext.onCommand(ctx, ext, sess, verb, args)
+	}
+
+	return Reply{
+		Code:  250,
+		Lines: []string{verb, args},
+	}, nil
+}
+
+func TestExtension(t *tst.T) {
+	ext := &testExtension{
+		advertise: "X-TEST one two",
+	}
+
+	server := NewServer(Config{
+		Domain:     "example.com",
+		Logger:     zap.NewExample(),
+		Extensions: []Extension{ext},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"XTEST before",
+		"EHLO domain.com",
+		"xtest after  ",
+		"MAIL FROM:<someone@domain.com> X-MAIL=1 SIZE=1",
+		"RCPT TO:<someone@example.com> X-RCPT",
+		"RCPT TO:<someone@example.com> X-MAIL=1",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"500 5.5.2 Syntax error, command unrecognized",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250-ENHANCEDSTATUSCODES",
+		"250 X-TEST one two",
+		"250-XTEST",
+		"250 after",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 1 != ext.commandCalls {
+		t.Errorf("Unexpected number of command calls: %v", ext.commandCalls)
+	}
+}
+
+func TestExtensionDisabled(t *tst.T) {
+	ext := &testExtension{
+		advertise: "",
+	}
+
+	server := NewServer(Config{
+		Domain:     "example.com",
+		Logger:     zap.NewExample(),
+		Extensions: []Extension{ext},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"XTEST",
+		"MAIL FROM:<someone@domain.com> X-MAIL=1",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"500 5.5.2 Syntax error, command unrecognized",
+		"555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+}
+
+func TestExtensionCommandError(t *tst.T) {
+	ext := &testExtension{
+		advertise: "X-TEST",
+		onCommand: func(ctx context.Context, ext *testExtension, sess *Session, verb string, args string) (Reply, error) {
+			return Reply{}, context.Canceled
+		},
+	}
+
+	server := NewServer(Config{
+		Domain:     "example.com",
+		Logger:     zap.NewExample(),
+		Extensions: []Extension{ext},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"XTEST",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+}
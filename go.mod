@@ -1,5 +1,14 @@
 module github.com/hf/smtp
 
-go 1.15
+go 1.17
 
-require go.uber.org/zap v1.16.0
+require (
+	go.uber.org/zap v1.16.0
+	golang.org/x/net v0.17.0
+)
+
+require (
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
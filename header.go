@@ -0,0 +1,334 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// A field of the header section of a message, RFC 5322 section 2.2.
+type HeaderField struct {
+	// The name of the field as sent, such as "Subject".
+	Name string
+
+	// The unfolded body of the field, without surrounding whitespace.
+	Raw string
+
+	// The body with RFC 2047 encoded-words decoded, or Raw if it has one in
+	// an unknown charset or that is malformed.
+	Value string
+}
+
+// The header section of a message, with its fields in the order they were
+// sent. Field names may occur more than once, as Received usually does.
+type Header []HeaderField
+
+// The decoded value of the first field with the name, which is
+// case-insensitive, or the empty string if there is none.
+func (header Header) Get(name string) string {
+	for _, field := range header {
+		if strings.EqualFold(name, field.Name) {
+			return field.Value
+		}
+	}
+
+	return ""
+}
+
+// The decoded values of all fields with the name, which is case-insensitive.
+func (header Header) Values(name string) []string {
+	var values []string
+
+	for _, field := range header {
+		if strings.EqualFold(name, field.Name) {
+			values = append(values, field.Value)
+		}
+	}
+
+	return values
+}
+
+// An Envelope can optionally implement HeaderEnvelope to receive the parsed
+// header section of messages, as sent by the client without the trace
+// headers added by the server.
+type HeaderEnvelope interface {
+	Envelope
+
+	// Inspect the header section, called once the empty line ending it has
+	// been written to the envelope, or before Commit if the message has no
+	// body. For a StreamEnvelope it is called while Data may still be
+	// reading. Messages with a header section over 64 KiB are rejected with
+	// a 552 reply instead.
+	//
+	// Returning a 4xx or 5xx Reply rejects the message, and the rest of its
+	// content is discarded. Returning another error rejects the message with
+	// a 554 reply.
+	Header(ctx context.Context, header Header) error
+}
+
+// Maximum size of the header section passed to a HeaderEnvelope.
+const headerSectionLimit = 64 * 1024
+
+type headerState = int
+
+const (
+	headerLineStart headerState = iota
+	headerEmptyLine             = iota
+	headerName                  = iota
+	headerColon                 = iota
+	headerRest                  = iota
+	headerBody                  = iota
+)
+
+var receivedName = []byte("received")
+
+// The header section of the content of a message, which ends with the first
+// empty line. It is tracked once for both detecting routing loops and a
+// HeaderEnvelope. A bare LF ends a line as well, as it does for most
+// consumers when bare line endings are passed on, while the content has no
+// bare LF otherwise.
+type headerSection struct {
+	state   headerState
+	matched int
+
+	// the Received fields in the section
+	received int
+
+	// whether the section is collected for a HeaderEnvelope, and the
+	// section so far
+	collect bool
+	buffer  []byte
+
+	// whether the header has been passed to the envelope or rejected
+	done bool
+}
+
+// Advances the section with the next octets of the content, returning
+// whether the empty line ending it is within them. The collected section
+// then holds its fields, without the empty line.
+func (section *headerSection) write(content []byte) bool {
+	if headerBody == section.state {
+		return false
+	}
+
+	for i, c := range content {
+		switch section.state {
+		case headerEmptyLine:
+			if '\n' == c {
+				section.end(content[:i+1], len(crlf))
+
+				return true
+			}
+
+			section.state = headerRest
+
+		case headerLineStart:
+			if '\n' == c {
+				section.end(content[:i+1], 1)
+
+				return true
+			}
+
+			if '\r' == c {
+				section.state = headerEmptyLine
+
+				continue
+			}
+
+			section.state = headerName
+			section.matched = 0
+		}
+
+		switch section.state {
+		case headerName:
+			// field names are case-insensitive, RFC 5322 section 1.2.2
+			if receivedName[section.matched] == c|0x20 {
+				section.matched++
+
+				if len(receivedName) == section.matched {
+					section.state = headerColon
+				}
+
+				continue
+			}
+
+			section.state = headerRest
+
+		case headerColon:
+			// whitespace before the colon is obsolete syntax, RFC 5322 section
+			// 4.5
+			if ':' == c {
+				section.received++
+				section.state = headerRest
+
+				continue
+			}
+
+			if ' ' == c || '\t' == c {
+				continue
+			}
+
+			section.state = headerRest
+		}
+
+		if '\n' == c {
+			section.state = headerLineStart
+		}
+	}
+
+	section.keep(content)
+
+	return false
+}
+
+// Ends the section with the last of its content, which ends with the empty
+// line of the length.
+func (section *headerSection) end(content []byte, emptyLine int) {
+	section.state = headerBody
+	section.keep(content)
+
+	if section.collect && !section.done {
+		section.buffer = section.buffer[:len(section.buffer)-emptyLine]
+	}
+}
+
+// Collects content of the section for a HeaderEnvelope.
+func (section *headerSection) keep(content []byte) {
+	if section.collect && !section.done {
+		section.buffer = append(section.buffer, content...)
+	}
+}
+
+// Parses the fields of a header section, such as that of a message nested in
+// a MIME part, without the empty line ending it. Lines may end in CRLF or a
+// bare LF. The fields are unfolded and their RFC 2047 encoded-words decoded.
+// Lines that are not fields are skipped, along with their continuation
+// lines.
+func ParseHeader(fields []byte) Header {
+	header := Header{}
+	decoder := mime.WordDecoder{}
+
+	// the current field, unfolded, or nil after a line that is not a field
+	var field []byte
+
+	addField := func() {
+		colon := bytes.IndexByte(field, ':')
+		name := bytes.TrimRight(field[:colon], " \t")
+
+		if 0 == len(name) {
+			return
+		}
+
+		raw := string(bytes.Trim(field[colon+1:], " \t"))
+
+		value, err := decoder.DecodeHeader(raw)
+		if nil != err {
+			value = raw
+		}
+
+		header = append(header, HeaderField{
+			Name:  string(name),
+			Raw:   raw,
+			Value: value,
+		})
+	}
+
+	for _, line := range bytes.Split(bytes.TrimSuffix(fields, []byte("\n")), []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) > 0 && (' ' == line[0] || '\t' == line[0]) {
+			// unfolding removes the line break but keeps the whitespace, RFC
+			// 5322 section 2.2.3
+			if nil != field {
+				field = append(field, line...)
+			}
+
+			continue
+		}
+
+		if nil != field {
+			addField()
+		}
+
+		field = nil
+
+		if bytes.IndexByte(line, ':') >= 0 {
+			field = append([]byte{}, line...)
+		}
+	}
+
+	if nil != field {
+		addField()
+	}
+
+	return header
+}
+
+// Advances the header section of the content, passing it to a
+// HeaderEnvelope once it has been read, and returning the reply rejecting the
+// message if any.
+func (sess *Session) advanceHeader(ctx context.Context, content []byte) Reply {
+	section := &sess.state.header
+
+	ended := section.write(content)
+
+	if !section.collect || section.done {
+		return Reply{}
+	}
+
+	if ended {
+		return sess.passHeader(ctx)
+	}
+
+	if len(section.buffer) > headerSectionLimit {
+		section.done = true
+		section.buffer = nil
+
+		return replyDATAHeaderTooLarge
+	}
+
+	return Reply{}
+}
+
+// Passes the rest of the header section to a HeaderEnvelope at the end of the
+// content, returning the reply rejecting the message if any.
+func (sess *Session) finishHeader(ctx context.Context) Reply {
+	section := &sess.state.header
+
+	if !section.collect || section.done {
+		return Reply{}
+	}
+
+	return sess.passHeader(ctx)
+}
+
+// Passes the fields of the header section to the HeaderEnvelope, returning
+// the reply rejecting the message if any.
+func (sess *Session) passHeader(ctx context.Context) Reply {
+	section := &sess.state.header
+	header := ParseHeader(section.buffer)
+
+	section.done = true
+	section.buffer = nil
+
+	err := sess.state.env.(HeaderEnvelope).Header(ctx, header)
+
+	if reply, ok := envelopeReply(err, sess.config.logger); ok {
+		if reply.positive() {
+			return Reply{}
+		}
+
+		return reply
+	}
+
+	if nil != err {
+		sess.config.logger.Warn("header failed", zap.Error(err))
+
+		return replyDATATransactionFailed
+	}
+
+	return Reply{}
+}
@@ -0,0 +1,25 @@
+package smtp_test
+
+import (
+	"fmt"
+
+	"github.com/hf/smtp"
+)
+
+func ExampleParseHeader() {
+	header := smtp.ParseHeader([]byte("Subject: =?UTF-8?Q?caf=C3=A9?=\r\n au lait\r\nReceived: from a\r\nReceived: from b\r\n"))
+
+	fmt.Println(header.Get("subject"))
+	fmt.Println(header.Values("Received"))
+
+	for _, field := range header {
+		fmt.Printf("%s: %q\n", field.Name, field.Raw)
+	}
+
+	// Output:
+	// café au lait
+	// [from a from b]
+	// Subject: "=?UTF-8?Q?caf=C3=A9?= au lait"
+	// Received: "from a"
+	// Received: "from b"
+}
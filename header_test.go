@@ -0,0 +1,172 @@
+package smtp
+
+import (
+	"context"
+	"reflect"
+	tst "testing"
+)
+
+type testHeaderEnvelope struct {
+	testEnvelope
+
+	headers []Header
+
+	onHeader func(ctx context.Context, env *testHeaderEnvelope, header Header) error
+}
+
+func (env *testHeaderEnvelope) Header(ctx context.Context, header Header) error {
+	env.headers = append(env.headers, header)
+
+	if nil != env.onHeader {
+		return env.onHeader(ctx, env, header)
+	}
+
+	return nil
+}
+
+func TestParseHeader(t *tst.T) {
+	examples := []struct {
+		Fields   string
+		Expected Header
+	}{
+		{"", Header{}},
+		{
+			"Subject: hello\r\nFrom: someone@example.com\r\n",
+			Header{
+				{"Subject", "hello", "hello"},
+				{"From", "someone@example.com", "someone@example.com"},
+			},
+		},
+		{
+			"To: a@example.com,\r\n b@example.com\r\nSubject:\r\n\tfolded  \r\n",
+			Header{
+				{"To", "a@example.com, b@example.com", "a@example.com, b@example.com"},
+				{"Subject", "folded", "folded"},
+			},
+		},
+		{
+			"Subject: =?UTF-8?Q?caf=C3=A9?= au lait\r\nX-Name: =?ISO-8859-1?B?SvZyZw==?=\r\n",
+			Header{
+				{"Subject", "=?UTF-8?Q?caf=C3=A9?= au lait", "café au lait"},
+				{"X-Name", "=?ISO-8859-1?B?SvZyZw==?=", "Jörg"},
+			},
+		},
+		{
+			"Subject: =?KOI8-R?Q?abc?=\r\n",
+			Header{
+				{"Subject", "=?KOI8-R?Q?abc?=", "=?KOI8-R?Q?abc?="},
+			},
+		},
+		{
+			" leading continuation\r\nnot a field\r\n more\r\n: no name\r\nReceived : from a\r\nreceived: from b",
+			Header{
+				{"Received", "from a", "from a"},
+				{"received", "from b", "from b"},
+			},
+		},
+		{
+			"Subject: bare\n line feeds\nFrom: someone@example.com\n",
+			Header{
+				{"Subject", "bare line feeds", "bare line feeds"},
+				{"From", "someone@example.com", "someone@example.com"},
+			},
+		},
+	}
+
+	for _, ex := range examples {
+		if header := ParseHeader([]byte(ex.Fields)); !reflect.DeepEqual(ex.Expected, header) {
+			t.Errorf("Unexpected header for %q: %v", ex.Fields, header)
+		}
+	}
+}
+
+func TestHeaderGet(t *tst.T) {
+	header := ParseHeader([]byte("Received: from a\r\nSubject: hello\r\nRECEIVED: from b\r\n"))
+
+	if value := header.Get("subject"); "hello" != value {
+		t.Errorf("Unexpected Subject: %q", value)
+	}
+
+	if value := header.Get("received"); "from a" != value {
+		t.Errorf("Unexpected first Received: %q", value)
+	}
+
+	if value := header.Get("To"); "" != value {
+		t.Errorf("Unexpected To: %q", value)
+	}
+
+	if values := header.Values("Received"); !reflect.DeepEqual([]string{"from a", "from b"}, values) {
+		t.Errorf("Unexpected Received values: %v", values)
+	}
+
+	if values := header.Values("To"); nil != values {
+		t.Errorf("Unexpected To values: %v", values)
+	}
+}
+
+func TestHeaderSectionWrite(t *tst.T) {
+	examples := []struct {
+		Content  string
+		Complete bool
+		Fields   string
+	}{
+		{"Subject: hello\r\n\r\nbody\r\n", true, "Subject: hello\r\n"},
+		{"\r\nbody\r\n", true, ""},
+		{"Subject: hello\r\nbody\r\n", false, "Subject: hello\r\nbody\r\n"},
+		{"Subject: hello\r\n\r", false, "Subject: hello\r\n\r"},
+		{"Subject: hello\n\nbody\n", true, "Subject: hello\n"},
+		{"Subject: hello\r\n\nbody\r\n", true, "Subject: hello\r\n"},
+		{"\nbody\n", true, ""},
+		{"Subject: hello\r\n\r\rbody\r\n\r\n", true, "Subject: hello\r\n\r\rbody\r\n"},
+	}
+
+	for _, ex := range examples {
+		for _, size := range []int{len(ex.Content), 1, 3} {
+			section := headerSection{collect: true}
+			complete := false
+
+			for i := 0; i < len(ex.Content) && !complete; i += size {
+				end := i + size
+				if end > len(ex.Content) {
+					end = len(ex.Content)
+				}
+
+				complete = section.write([]byte(ex.Content[i:end]))
+			}
+
+			if ex.Complete != complete || ex.Fields != string(section.buffer) {
+				t.Errorf("Unexpected header section of %q in pieces of %v: %v %q", ex.Content, size, complete, section.buffer)
+			}
+		}
+	}
+}
+
+func TestHeaderSectionReceived(t *tst.T) {
+	examples := []struct {
+		Content  string
+		Expected int
+	}{
+		{"", 0},
+		{"Received: from a\r\nReceived: from b\r\n\r\nhello\r\n", 2},
+		{"received: from a\r\n\tby b\r\nRECEIVED : from c\r\n\r\n", 2},
+		{"Subject: Received: spam\r\nX-Received: from a\r\nReceive: a\r\nReceivedX: a\r\n\r\n", 0},
+		{"Received: from a\r\n\r\nReceived: from b\r\n", 1},
+		{"Received: from a\r\n\r\rReceived: from b\r\n", 1},
+		{"Received: from a\nReceived: from b\n\nReceived: from c\n", 2},
+		{"hello\r\n", 0},
+	}
+
+	for _, ex := range examples {
+		whole := headerSection{}
+		whole.write([]byte(ex.Content))
+
+		pieces := headerSection{}
+		for i := range ex.Content {
+			pieces.write([]byte(ex.Content[i : i+1]))
+		}
+
+		if ex.Expected != whole.received || ex.Expected != pieces.received {
+			t.Errorf("Unexpected number of Received headers in %q: %v, %v in pieces", ex.Content, whole.received, pieces.received)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package smtp
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Prefix of A-labels, the ASCII form of internationalized domain labels.
+const aLabelPrefix = "xn--"
+
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i += 1 {
+		if str[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lower-cases the ASCII letters of the string, leaving others as they are.
+func lowerASCII(str string) string {
+	lower := []byte(str)
+
+	for i, c := range lower {
+		if 'A' <= c && c <= 'Z' {
+			lower[i] = c + 'a' - 'A'
+		}
+	}
+
+	return string(lower)
+}
+
+// Whether the label is a valid LDH label of at most 63 octets.
+func isLDHLabel(label string) bool {
+	if 0 == len(label) || len(label) > 63 || !isLetDig(label[0]) || '-' == label[len(label)-1] {
+		return false
+	}
+
+	for i := 0; i < len(label); i += 1 {
+		if !isLetDig(label[i]) && '-' != label[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether the LDH label has hyphens in the third and fourth position, which
+// are reserved for A-labels, RFC 5890 section 2.3.1.
+func hasReservedHyphens(label string) bool {
+	return len(label) >= 4 && "--" == label[2:4]
+}
+
+// Whether the domain consists of valid LDH labels and U-labels, RFC 5890
+// section 2.3.2. LDH labels with reserved hyphens must be valid A-labels.
+// Internationalized domains are validated with the IDNA2008 registration
+// profile, which does not map them, so U-labels must already be in NFC and
+// lower case. Like in LDH labels, ASCII letters may be in either case.
+func isDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	international := false
+
+	for _, label := range labels {
+		if !isASCII(label) {
+			international = true
+			continue
+		}
+
+		if !isLDHLabel(label) {
+			return false
+		}
+
+		if hasReservedHyphens(label) {
+			international = true
+		}
+	}
+
+	if !international {
+		return true
+	}
+
+	if !utf8.ValidString(domain) {
+		return false
+	}
+
+	unicode, err := idna.Registration.ToUnicode(lowerASCII(domain))
+	if nil != err {
+		return false
+	}
+
+	// an A-label must decode to a label which is not all ASCII
+	for i, label := range strings.Split(unicode, ".") {
+		if hasReservedHyphens(labels[i]) && isASCII(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether the domain has A-labels.
+func hasALabel(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) >= len(aLabelPrefix) && strings.EqualFold(aLabelPrefix, label[:len(aLabelPrefix)]) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package smtp
+
+import (
+	tst "testing"
+)
+
+func TestDomain(t *tst.T) {
+	examples := map[string]bool{
+		"example":               true,
+		"Example-1.com":         true,
+		"bücher.example":        true,
+		"Bücher.EXAMPLE":        true,
+		"例子.广告":                 true,
+		"mail.例子.xn--4rr70v":    true,
+		"xn--bcher-kva.example": true,
+		"XN--BCHER-KVA.example": true,
+		"אב.example":            true,
+		"BÜCHER.example":        false,
+		"xn--bcher-kvb.example": false,
+		"xn--abc-.example":      false,
+		"ab--cd.example":        false,
+		"-bücher.example":       false,
+		"bü_cher.example":       false,
+		"bü\xffcher.example":    false,
+		"\u0301bücher.example":  false,
+		"bu\u0308cher.example":  false,
+		"a\u200db.example":      false,
+		"אa.example":            false,
+		"א.1a":                  false,
+		"a_b.example":           false,
+		"":                      false,
+	}
+
+	for domain, valid := range examples {
+		if valid != isDomain(domain) {
+			t.Errorf("Unexpected validity of %q", domain)
+		}
+	}
+}
+
+func TestHasALabel(t *tst.T) {
+	examples := map[string]bool{
+		"example.com":           false,
+		"bücher.example":        false,
+		"xn--bcher-kva.example": true,
+		"mail.XN--4rr70v":       true,
+		"axn--b.example":        false,
+	}
+
+	for domain, expected := range examples {
+		if expected != hasALabel(domain) {
+			t.Errorf("Unexpected A-labels in %q", domain)
+		}
+	}
+}
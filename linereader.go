@@ -4,30 +4,70 @@ import (
 	"bytes"
 )
 
+// Handling of a bare CR or LF, one that is not part of a CRLF. Other MTAs may
+// interpret these as line endings, which can be used to smuggle a message or
+// commands past the end of the content of another message.
+type BareLineEndings = int
+
+const (
+	// Commands with a bare CR or LF are rejected with a 500 reply, and a
+	// message with one in its content with a 554 reply at its end.
+	RejectBareLineEndings BareLineEndings = iota
+
+	// A bare LF ends a line as if it were a CRLF, but never the content of a
+	// message, which requires a CRLF before and after the final dot. A bare
+	// CR in the content of a message is written as a CRLF, while commands
+	// with one are rejected.
+	NormalizeBareLineEndings = iota
+
+	// Bare CR and LF are passed on as any other octet.
+	PassBareLineEndings = iota
+)
+
 type lineControl = int
 
 const (
 	readMoreLines lineControl = iota
 	discardLines              = iota
+	pauseLines                = iota
 )
 
-func readLines(buffer []byte, cb func(line []byte) lineControl) []byte {
+var crlf = []byte("\r\n")
+
+// Calls cb with each line in the buffer, ending with a CRLF or also with a
+// bare LF if bareLF is set, returning the rest of the buffer.
+func readLines(buffer []byte, bareLF bool, cb func(line []byte) lineControl) []byte {
 	chunk := buffer
 
 	for {
-		crlf := bytes.Index(chunk, []byte("\r\n"))
+		// index of the LF ending the line
+		var lf int
+
+		if bareLF {
+			lf = bytes.IndexByte(chunk, '\n')
+		} else if lf = bytes.Index(chunk, crlf); lf >= 0 {
+			lf += 1
+		}
 
-		if crlf < 0 {
+		if lf < 0 {
 			return chunk
 		} else {
-			crlf += 2
-			line := chunk[:crlf]
-			chunk = chunk[crlf:]
+			line := chunk[:lf+1]
+			chunk = chunk[lf+1:]
 
 			switch cb(line) {
 			case discardLines:
 				return nil
+
+			case pauseLines:
+				// the caller continues with the rest of the buffer itself
+				return chunk
 			}
 		}
 	}
 }
+
+// Whether the line contains a bare CR or LF, other than its CRLF ending.
+func hasBareLineEnding(line []byte) bool {
+	return bytes.IndexAny(bytes.TrimSuffix(line, crlf), "\r\n") >= 0
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"bytes"
+	"reflect"
 	tst "testing"
 )
 
@@ -9,7 +10,7 @@ func TestReadLines(t *tst.T) {
 	buffer := []byte("MAIL FROM:<someone@example.com>\r\nDATA")
 
 	calls := 0
-	leftover := readLines(buffer, func(line []byte) lineControl {
+	leftover := readLines(buffer, false, func(line []byte) lineControl {
 		calls += 1
 
 		if !bytes.Equal(line, []byte("MAIL FROM:<someone@example.com>\r\n")) {
@@ -30,7 +31,7 @@ func TestReadLines(t *tst.T) {
 
 func TestReadLinesStopReading(t *tst.T) {
 	calls := 0
-	leftover := readLines([]byte("ABC\r\n"), func(line []byte) lineControl {
+	leftover := readLines([]byte("ABC\r\n"), false, func(line []byte) lineControl {
 		calls += 1
 		return discardLines
 	})
@@ -43,3 +44,72 @@ func TestReadLinesStopReading(t *tst.T) {
 		t.Errorf("Unexpected number of callbacks: %v", calls)
 	}
 }
+
+func TestReadLinesPause(t *tst.T) {
+	calls := 0
+	leftover := readLines([]byte("BDAT 3\r\nabcQUIT\r\n"), false, func(line []byte) lineControl {
+		calls += 1
+		return pauseLines
+	})
+
+	if !bytes.Equal(leftover, []byte("abcQUIT\r\n")) {
+		t.Errorf("Unexpected leftover: %q", string(leftover))
+	}
+
+	if 1 != calls {
+		t.Errorf("Unexpected number of callbacks: %v", calls)
+	}
+}
+
+func TestReadLinesBareLF(t *tst.T) {
+	examples := []struct {
+		BareLF   bool
+		Lines    []string
+		Leftover string
+	}{
+		{
+			BareLF:   false,
+			Lines:    []string{"A\nB\r\n", "C\r\n"},
+			Leftover: "\rD\n",
+		},
+		{
+			BareLF:   true,
+			Lines:    []string{"A\n", "B\r\n", "C\r\n", "\rD\n"},
+			Leftover: "",
+		},
+	}
+
+	for _, ex := range examples {
+		lines := make([]string, 0, len(ex.Lines))
+		leftover := readLines([]byte("A\nB\r\nC\r\n\rD\n"), ex.BareLF, func(line []byte) lineControl {
+			lines = append(lines, string(line))
+			return readMoreLines
+		})
+
+		if !reflect.DeepEqual(ex.Lines, lines) || ex.Leftover != string(leftover) {
+			t.Errorf("Unexpected lines for bare LF %v: %q %q", ex.BareLF, lines, leftover)
+		}
+	}
+}
+
+func TestHasBareLineEnding(t *tst.T) {
+	examples := map[string]bool{
+		"":                 false,
+		"hello\r\n":        false,
+		"hello":            false,
+		"hello\n.\r\n":     true,
+		"hello\r.\r\n":     true,
+		"hello\r\r\n":      true,
+		"hello\n":          true,
+		"hello\rworld":     true,
+		".\r\n":            false,
+		"\r\n.\r\n":        true,
+		"MAIL FROM:<>\r\n": false,
+	}
+
+	for line, bare := range examples {
+		if bare != hasBareLineEnding([]byte(line)) {
+			t.Errorf("Unexpected bare line ending for %q", line)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package mimeparse
+
+import (
+	"unicode/utf8"
+)
+
+// Converts text in a charset to UTF-8. The content of a part is converted in
+// pieces, which may end within the octets of a character that a Converter
+// then keeps until the next piece.
+type Converter interface {
+	// Appends the converted content to dst.
+	Convert(dst, content []byte) []byte
+
+	// Appends what is left of the content to dst at the end of the part, such
+	// as a replacement for an incomplete character.
+	Finish(dst []byte) []byte
+}
+
+// Passes UTF-8 as is, replacing octets which are not part of a valid
+// character with U+FFFD. US-ASCII is passed the same way, as senders often
+// mislabel UTF-8 as it.
+type utf8Converter struct {
+	// the start of a character at the end of the last piece
+	pending []byte
+}
+
+func (converter *utf8Converter) Convert(dst, content []byte) []byte {
+	if 0 != len(converter.pending) {
+		content = append(converter.pending, content...)
+		converter.pending = nil
+	}
+
+	for 0 != len(content) {
+		r, n := utf8.DecodeRune(content)
+
+		switch {
+		case utf8.RuneError != r || 1 != n:
+			dst = append(dst, content[:n]...)
+
+		case !utf8.FullRune(content):
+			converter.pending = append([]byte{}, content...)
+			return dst
+
+		default:
+			dst = append(dst, string(utf8.RuneError)...)
+		}
+
+		content = content[n:]
+	}
+
+	return dst
+}
+
+func (converter *utf8Converter) Finish(dst []byte) []byte {
+	if 0 != len(converter.pending) {
+		converter.pending = nil
+		dst = append(dst, string(utf8.RuneError)...)
+	}
+
+	return dst
+}
+
+// Converts a charset with a single octet for each character, mapping the
+// octets from 0x80 to runes.
+type singleOctetConverter [128]rune
+
+func (table *singleOctetConverter) Convert(dst, content []byte) []byte {
+	var encoded [utf8.UTFMax]byte
+
+	for _, c := range content {
+		if c < 0x80 {
+			dst = append(dst, c)
+		} else {
+			n := utf8.EncodeRune(encoded[:], table[c-0x80])
+			dst = append(dst, encoded[:n]...)
+		}
+	}
+
+	return dst
+}
+
+func (table *singleOctetConverter) Finish(dst []byte) []byte {
+	return dst
+}
+
+var latin1 = &singleOctetConverter{}
+
+// Windows-1252 is ISO-8859-1 with printable characters in place of the C1
+// controls, which are kept where it has none as by the WHATWG encoding
+// standard.
+var windows1252 = &singleOctetConverter{}
+
+var windows1252Controls = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+func init() {
+	for i := range latin1 {
+		latin1[i] = rune(0x80 + i)
+		windows1252[i] = rune(0x80 + i)
+	}
+
+	copy(windows1252[:], windows1252Controls[:])
+}
+
+// The Converter for a built-in charset, or nil if the charset is not
+// built-in, along with whether it is.
+func builtinConverter(charset string) (Converter, bool) {
+	switch charset {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return &utf8Converter{}, true
+
+	case "iso-8859-1", "iso_8859-1", "latin1", "l1":
+		return latin1, true
+
+	case "windows-1252", "cp1252":
+		return windows1252, true
+
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,51 @@
+package mimeparse
+
+import (
+	tst "testing"
+)
+
+func TestBuiltinConverter(t *tst.T) {
+	examples := []struct {
+		Charset  string
+		Content  string
+		Expected string
+		Known    bool
+	}{
+		{"utf-8", "caf\xc3\xa9", "caf\xc3\xa9", true},
+		{"utf-8", "a\xffb\xc3(\xef\xbf\xbd", "a\ufffdb\ufffd(\ufffd", true},
+		{"utf-8", "caf\xc3", "caf\ufffd", true},
+		{"us-ascii", "hello", "hello", true},
+		{"us-ascii", "J\xf6rg", "J\ufffdrg", true},
+		{"iso-8859-1", "J\xf6rg \xa0\xff", "Jörg  ÿ", true},
+		{"windows-1252", "\x80 \x93quoted\x94 \x81 \xe9", "€ “quoted” \u0081 é", true},
+		{"koi8-r", "\xc1", "\xc1", false},
+	}
+
+	for _, ex := range examples {
+		converter, known := builtinConverter(ex.Charset)
+
+		converted := ex.Content
+		if nil != converter {
+			converted = string(converter.Finish(converter.Convert(nil, []byte(ex.Content))))
+		}
+
+		if ex.Known != known || ex.Expected != converted {
+			t.Errorf("Unexpected conversion from %v: %v %q", ex.Charset, known, converted)
+		}
+	}
+}
+
+func TestUTF8ConverterPieces(t *tst.T) {
+	converter := &utf8Converter{}
+
+	var converted []byte
+	for _, piece := range []string{"caf\xc3", "\xa9 \xe2", "\x82", "\xac", " \xf0\x9f"} {
+		converted = converter.Convert(converted, []byte(piece))
+	}
+
+	converted = converter.Finish(converted)
+
+	if "café € \ufffd" != string(converted) {
+		t.Errorf("Unexpected conversion: %q", converted)
+	}
+}
@@ -0,0 +1,210 @@
+package mimeparse
+
+import (
+	"bytes"
+	"encoding/base64"
+)
+
+var crlf = []byte("\r\n")
+
+// Decodes the Content-Transfer-Encoding of the lines of a part. The line
+// break ending a line is only passed with the next one, as the one before a
+// boundary delimiter belongs to the delimiter, RFC 2046 section 5.1.1.
+type transferDecoder interface {
+	// Appends the decoded content to dst, which is a line if ended is set or
+	// otherwise a piece of one, preceded by a line break if lineBreak is set.
+	decode(dst, content []byte, lineBreak, ended bool) []byte
+
+	// Appends the rest of the decoded content to dst at the end of the part,
+	// with a last line break if lineBreak is set.
+	finish(dst []byte, lineBreak bool) []byte
+}
+
+// Whether the encoding leaves the content as is, RFC 2045 section 6.2.
+func identityEncoding(encoding string) bool {
+	switch encoding {
+	case "7bit", "8bit", "binary":
+		return true
+
+	default:
+		return false
+	}
+}
+
+func newTransferDecoder(encoding string) transferDecoder {
+	switch encoding {
+	case "quoted-printable":
+		return &quotedPrintableDecoder{}
+
+	case "base64":
+		return &base64Decoder{}
+
+	default:
+		// unknown encodings are passed as is for the handler to judge
+		return identityDecoder{}
+	}
+}
+
+type identityDecoder struct{}
+
+func (identityDecoder) decode(dst, content []byte, lineBreak, ended bool) []byte {
+	if lineBreak {
+		dst = append(dst, crlf...)
+	}
+
+	return append(dst, content...)
+}
+
+func (identityDecoder) finish(dst []byte, lineBreak bool) []byte {
+	if lineBreak {
+		dst = append(dst, crlf...)
+	}
+
+	return dst
+}
+
+// Decodes quoted-printable, RFC 2045 section 6.7. Malformed escapes are
+// passed as is, as recommended.
+type quotedPrintableDecoder struct {
+	// whether the last line ended with a soft line break
+	softBreak bool
+
+	// whitespace or the start of an escape at the end of a piece of a line
+	escape []byte
+}
+
+func (decoder *quotedPrintableDecoder) decode(dst, content []byte, lineBreak, ended bool) []byte {
+	if lineBreak && !decoder.softBreak {
+		dst = append(dst, crlf...)
+	}
+
+	decoder.softBreak = false
+
+	if 0 != len(decoder.escape) {
+		content = append(decoder.escape, content...)
+		decoder.escape = nil
+	}
+
+	if ended {
+		// trailing whitespace was added in transport, rule 3
+		content = bytes.TrimRight(content, " \t")
+
+		if bytes.HasSuffix(content, []byte("=")) {
+			decoder.softBreak = true
+			content = content[:len(content)-1]
+		}
+	} else {
+		// whitespace and an escape at the end of a piece are only decoded
+		// once it is known how the line continues
+		keep := len(bytes.TrimRight(content, " \t"))
+
+		if escape := bytes.LastIndexByte(content, '='); escape >= 0 && escape >= len(content)-2 && escape < keep {
+			keep = escape
+		}
+
+		decoder.escape = append([]byte{}, content[keep:]...)
+		content = content[:keep]
+	}
+
+	for i := 0; i < len(content); i++ {
+		if '=' == content[i] && i+2 < len(content) && isHex(content[i+1]) && isHex(content[i+2]) {
+			dst = append(dst, unhex(content[i+1])<<4|unhex(content[i+2]))
+			i += 2
+		} else {
+			dst = append(dst, content[i])
+		}
+	}
+
+	return dst
+}
+
+func (decoder *quotedPrintableDecoder) finish(dst []byte, lineBreak bool) []byte {
+	dst = append(dst, decoder.escape...)
+	decoder.escape = nil
+
+	if lineBreak && !decoder.softBreak {
+		dst = append(dst, crlf...)
+	}
+
+	return dst
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F') || ('a' <= c && c <= 'f')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10
+
+	default:
+		return c - 'a' + 10
+	}
+}
+
+// Decodes base64, RFC 2045 section 6.8. Characters outside the alphabet are
+// ignored, and malformed quanta skipped.
+type base64Decoder struct {
+	// characters of an incomplete quantum
+	quantum []byte
+}
+
+func (decoder *base64Decoder) decode(dst, content []byte, lineBreak, ended bool) []byte {
+	encoded := decoder.quantum
+
+	for _, c := range content {
+		if isBase64(c) {
+			encoded = append(encoded, c)
+		}
+	}
+
+	complete := len(encoded) / 4 * 4
+	dst = decodeBase64(dst, encoded[:complete])
+	decoder.quantum = append(decoder.quantum[:0], encoded[complete:]...)
+
+	return dst
+}
+
+func (decoder *base64Decoder) finish(dst []byte, lineBreak bool) []byte {
+	quantum := decoder.quantum
+	decoder.quantum = nil
+
+	// a quantum without its padding still carries octets
+	if len(quantum) < 2 {
+		return dst
+	}
+
+	for len(quantum) < 4 {
+		quantum = append(quantum, '=')
+	}
+
+	return decodeBase64(dst, quantum)
+}
+
+func isBase64(c byte) bool {
+	return ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || '+' == c || '/' == c || '=' == c
+}
+
+// Appends the decoded quanta to dst, skipping malformed ones.
+func decodeBase64(dst, quanta []byte) []byte {
+	start := len(dst)
+
+	for 0 != len(quanta) {
+		dst = append(dst, 0, 0, 0)
+
+		n, err := base64.StdEncoding.Decode(dst[start:], quanta[:4])
+		if nil != err {
+			n = 0
+		}
+
+		dst = dst[:start+n]
+		start += n
+		quanta = quanta[4:]
+	}
+
+	return dst
+}
@@ -0,0 +1,73 @@
+package mimeparse
+
+import (
+	tst "testing"
+)
+
+// Decodes the lines of content as the parser would, splitting each line in
+// pieces of the size if not 0.
+func testDecode(decoder transferDecoder, lines []string, size int) string {
+	var dst []byte
+
+	lineBreak := false
+
+	for _, line := range lines {
+		start := 0
+
+		for 0 != size && len(line)-start > size {
+			dst = decoder.decode(dst, []byte(line[start:start+size]), lineBreak, false)
+			lineBreak = false
+			start += size
+		}
+
+		dst = decoder.decode(dst, []byte(line[start:]), lineBreak, true)
+		lineBreak = true
+	}
+
+	return string(decoder.finish(dst, false))
+}
+
+func TestTransferDecoders(t *tst.T) {
+	examples := []struct {
+		Encoding string
+		Lines    []string
+		Expected string
+	}{
+		{"7bit", []string{"hello", "", "world"}, "hello\r\n\r\nworld"},
+		{"x-unknown", []string{"=41"}, "=41"},
+		{"quoted-printable", []string{"J=F6rg=20", "caf=C3=A9 =", "soft"}, "J\xf6rg \r\ncaf\xc3\xa9 soft"},
+		{"quoted-printable", []string{"trailing  \t", "=4x =", "=3D="}, "trailing\r\n=4x ="},
+		{"quoted-printable", []string{"lower =e9 =", ""}, "lower \xe9 "},
+		{"base64", []string{"aGVsbG8g", "d29y bGQ=", ""}, "hello world"},
+		{"base64", []string{"aGk=aGk=", "*a*G*k"}, "hihihi"},
+		{"base64", []string{"Q===", "aGk"}, "hi"},
+	}
+
+	for _, ex := range examples {
+		for _, size := range []int{0, 1, 2} {
+			if decoded := testDecode(newTransferDecoder(ex.Encoding), ex.Lines, size); ex.Expected != decoded {
+				t.Errorf("Unexpected %v decoding of %q in pieces of %v: %q", ex.Encoding, ex.Lines, size, decoded)
+			}
+		}
+	}
+}
+
+func TestTransferDecoderFinish(t *tst.T) {
+	examples := []struct {
+		Encoding string
+		Expected string
+	}{
+		{"7bit", "abc\r\n"},
+		{"quoted-printable", "abc\r\n"},
+		{"base64", "i\xb7"},
+	}
+
+	for _, ex := range examples {
+		decoder := newTransferDecoder(ex.Encoding)
+		dst := decoder.decode(nil, []byte("abc"), false, true)
+
+		if decoded := string(decoder.finish(dst, true)); ex.Expected != decoded {
+			t.Errorf("Unexpected %v content with a last line break: %q", ex.Encoding, decoded)
+		}
+	}
+}
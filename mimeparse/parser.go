@@ -0,0 +1,371 @@
+// Package mimeparse parses the MIME structure of messages as they are
+// received, decoding the content of their parts without holding whole
+// messages in memory.
+//
+// A Parser is an io.Writer, so an Envelope can pass it the content of a
+// message from Write, or a StreamEnvelope copy the content into it, and call
+// Close before it commits:
+//
+//	func (env *scanEnvelope) Write(ctx context.Context, line []byte) error {
+//		_, err := env.parser.Write(line)
+//		return err
+//	}
+package mimeparse
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/hf/smtp"
+)
+
+// Receives the structure and decoded content of a message from a Parser.
+// Returning an error stops the parser, which then returns it from Write and
+// Close.
+type Handler interface {
+	// The start of a part, once its header section has been read. The parts
+	// of a multipart and the message of a message/rfc822 part are started
+	// and ended between the start and end of the part.
+	StartPart(part *Part) error
+
+	// Content of a part which has no nested parts, in pieces, with its
+	// Content-Transfer-Encoding decoded and converted to UTF-8 if the part
+	// reports so. The content is only valid during the call.
+	PartData(part *Part, content []byte) error
+
+	// The end of a part, at the boundary delimiter following it or at the
+	// end of the message.
+	EndPart(part *Part) error
+}
+
+type Config struct {
+	// Receiver of the parts of messages.
+	Handler Handler
+
+	// Returns a Converter to UTF-8 for a charset other than the built-in
+	// UTF-8, US-ASCII, ISO-8859-1 and Windows-1252, or nil if the charset is
+	// unknown, in which case text in it is passed unconverted. If
+	// unspecified, only the built-in charsets are converted.
+	Charset func(charset string) Converter
+}
+
+// Returned by a Parser if the header section of a part exceeds 64 KiB.
+var ErrHeaderTooLarge = errors.New("mimeparse: header section too large")
+
+const (
+	// maximum size of the header section of a part
+	headerLimit = 64 * 1024
+
+	// longer lines are passed in pieces, which cannot be boundary delimiters
+	// as those are limited to 76 octets
+	lineLimit = 8 * 1024
+
+	// deeper multipart and message/rfc822 parts are not nested
+	depthLimit = 32
+)
+
+var dashes = []byte("--")
+
+// A part being parsed, with those containing it.
+type frame struct {
+	part   *Part
+	parent *Part
+	index  int
+
+	// the header section, until its end has been read
+	inHeader bool
+	header   []byte
+
+	// "--" and the boundary of a multipart, and its parts so far
+	delimiter []byte
+	parts     int
+
+	// decoding of the content of a part without nested parts, and whether
+	// the last line ended
+	decoder   transferDecoder
+	converter Converter
+	lineBreak bool
+}
+
+// Parses a message passed in pieces, calling the Handler with its parts.
+type Parser struct {
+	config Config
+
+	// the parts being parsed, from the message to the innermost one
+	frames []*frame
+
+	// an incomplete line, and whether its start was passed as a piece
+	pending   []byte
+	continued bool
+
+	// scratch space for decoded and converted content
+	decoded   []byte
+	converted []byte
+
+	err error
+}
+
+func NewParser(config Config) *Parser {
+	return &Parser{
+		config: config,
+		frames: []*frame{{inHeader: true}},
+	}
+}
+
+// Adds content of the message, which can be in pieces of any size.
+func (parser *Parser) Write(content []byte) (int, error) {
+	if nil != parser.err {
+		return 0, parser.err
+	}
+
+	parser.pending = append(parser.pending, content...)
+	buffer := parser.pending
+
+	for nil == parser.err {
+		lf := bytes.IndexByte(buffer, '\n')
+		if lf < 0 {
+			break
+		}
+
+		parser.err = parser.line(buffer[:lf+1], true)
+		buffer = buffer[lf+1:]
+	}
+
+	if nil == parser.err && len(buffer) > lineLimit {
+		piece := buffer
+
+		// the CR may be the start of the line break
+		if '\r' == piece[len(piece)-1] {
+			piece = piece[:len(piece)-1]
+		}
+
+		parser.err = parser.line(piece, false)
+		buffer = buffer[len(piece):]
+	}
+
+	parser.pending = append(parser.pending[:0], buffer...)
+
+	if nil != parser.err {
+		return 0, parser.err
+	}
+
+	return len(content), nil
+}
+
+// Ends the message, ending all parts. The Parser cannot be used afterwards.
+func (parser *Parser) Close() error {
+	if nil != parser.err {
+		return parser.err
+	}
+
+	if 0 != len(parser.pending) {
+		parser.err = parser.line(parser.pending, false)
+		parser.pending = nil
+	}
+
+	if nil == parser.err {
+		// the line break ending the message is part of its content
+		parser.err = parser.endFrames(0, true)
+	}
+
+	return parser.err
+}
+
+// Parses a line including its line break if ended, or otherwise a piece of a
+// line.
+func (parser *Parser) line(line []byte, ended bool) error {
+	content := line
+
+	if ended {
+		content = bytes.TrimSuffix(bytes.TrimSuffix(content, []byte("\n")), []byte("\r"))
+	}
+
+	continued := parser.continued
+	parser.continued = !ended
+
+	if !continued {
+		if level, closing, ok := parser.delimiter(content); ok {
+			return parser.boundary(level, closing)
+		}
+	}
+
+	if 0 == len(parser.frames) {
+		// the epilogue of the message
+		return nil
+	}
+
+	top := parser.frames[len(parser.frames)-1]
+
+	switch {
+	case top.inHeader:
+		if ended && !continued && 0 == len(content) {
+			return parser.startPart(top)
+		}
+
+		top.header = append(top.header, content...)
+		if ended {
+			top.header = append(top.header, crlf...)
+		}
+
+		if len(top.header) > headerLimit {
+			return ErrHeaderTooLarge
+		}
+
+		return nil
+
+	case nil != top.delimiter:
+		// the preamble of a multipart, or the epilogue of a nested one
+		return nil
+
+	default:
+		parser.decoded = top.decoder.decode(parser.decoded[:0], content, top.lineBreak, ended)
+		top.lineBreak = ended
+
+		return parser.data(top, parser.decoded, false)
+	}
+}
+
+// The level of the multipart a line is a boundary delimiter of, and whether
+// it is the close delimiter, RFC 2046 section 5.1.1.
+func (parser *Parser) delimiter(content []byte) (int, bool, bool) {
+	if !bytes.HasPrefix(content, dashes) {
+		return 0, false, false
+	}
+
+	// transport padding is ignored
+	content = bytes.TrimRight(content, " \t")
+
+	for level := len(parser.frames) - 1; level >= 0; level-- {
+		delimiter := parser.frames[level].delimiter
+
+		if nil == delimiter || !bytes.HasPrefix(content, delimiter) {
+			continue
+		}
+
+		switch rest := content[len(delimiter):]; {
+		case 0 == len(rest):
+			return level, false, true
+
+		case bytes.Equal(rest, dashes):
+			return level, true, true
+		}
+	}
+
+	return 0, false, false
+}
+
+// Ends the parts within the multipart at the level, and starts the next part
+// of it or ends it too if closing.
+func (parser *Parser) boundary(level int, closing bool) error {
+	err := parser.endFrames(level+1, false)
+	if nil != err {
+		return err
+	}
+
+	if closing {
+		return parser.endFrames(level, false)
+	}
+
+	multipart := parser.frames[level]
+	multipart.parts += 1
+
+	parser.frames = append(parser.frames, &frame{
+		parent:   multipart.part,
+		index:    multipart.parts - 1,
+		inHeader: true,
+	})
+
+	return nil
+}
+
+// Starts the part of the frame once its header section has been read.
+func (parser *Parser) startPart(top *frame) error {
+	part := newPart(smtp.ParseHeader(top.header), top.parent, top.index)
+
+	top.part = part
+	top.inHeader = false
+	top.header = nil
+
+	nested := part.Depth < depthLimit
+
+	switch {
+	case nested && part.IsMultipart():
+		top.delimiter = append(dashes[:len(dashes):len(dashes)], part.Params["boundary"]...)
+
+	case nested && part.IsMessage():
+		parser.frames = append(parser.frames, &frame{
+			parent:   part,
+			inHeader: true,
+		})
+
+	default:
+		top.decoder = newTransferDecoder(part.Encoding)
+
+		if "" != part.Charset {
+			top.converter, part.UTF8 = builtinConverter(part.Charset)
+
+			if !part.UTF8 && nil != parser.config.Charset {
+				top.converter = parser.config.Charset(part.Charset)
+				part.UTF8 = nil != top.converter
+			}
+		}
+	}
+
+	return parser.config.Handler.StartPart(part)
+}
+
+// Ends the parts of the frames from the level on, with a last line break if
+// lineBreak is set and the innermost part ended with one.
+func (parser *Parser) endFrames(level int, lineBreak bool) error {
+	for len(parser.frames) > level {
+		top := parser.frames[len(parser.frames)-1]
+
+		if top.inHeader {
+			// a part ending within its header section has no content, and
+			// nested parts are ended as well
+			err := parser.startPart(top)
+			if nil != err {
+				return err
+			}
+
+			continue
+		}
+
+		if nil != top.decoder {
+			parser.decoded = top.decoder.finish(parser.decoded[:0], lineBreak && top.lineBreak)
+
+			err := parser.data(top, parser.decoded, true)
+			if nil != err {
+				return err
+			}
+		}
+
+		parser.frames = parser.frames[:len(parser.frames)-1]
+
+		err := parser.config.Handler.EndPart(top.part)
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Passes decoded content of the part to the handler, which is the last of it
+// if ended.
+func (parser *Parser) data(top *frame, decoded []byte, ended bool) error {
+	if nil != top.converter {
+		parser.converted = top.converter.Convert(parser.converted[:0], decoded)
+		if ended {
+			parser.converted = top.converter.Finish(parser.converted)
+		}
+
+		decoded = parser.converted
+	}
+
+	if 0 == len(decoded) {
+		return nil
+	}
+
+	return parser.config.Handler.PartData(top.part, decoded)
+}
@@ -0,0 +1,337 @@
+package mimeparse
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	tst "testing"
+)
+
+type testHandler struct {
+	events  []string
+	content map[string]string
+
+	onStart func(part *Part) error
+}
+
+func testPartPath(part *Part) string {
+	if nil == part.Parent {
+		return "0"
+	}
+
+	return testPartPath(part.Parent) + "." + strconv.Itoa(part.Index)
+}
+
+func (handler *testHandler) StartPart(part *Part) error {
+	event := "start " + testPartPath(part) + " " + part.MediaType
+
+	if "" != part.Filename {
+		event += " " + part.Filename
+	}
+
+	if part.UTF8 {
+		event += " utf8"
+	}
+
+	handler.events = append(handler.events, event)
+
+	if nil != handler.onStart {
+		return handler.onStart(part)
+	}
+
+	return nil
+}
+
+func (handler *testHandler) PartData(part *Part, content []byte) error {
+	if nil == handler.content {
+		handler.content = map[string]string{}
+	}
+
+	handler.content[testPartPath(part)] += string(content)
+
+	return nil
+}
+
+func (handler *testHandler) EndPart(part *Part) error {
+	handler.events = append(handler.events, "end "+testPartPath(part))
+
+	return nil
+}
+
+// Parses the message in pieces of the size, or as a whole if 0.
+func testParse(config Config, message string, size int) error {
+	parser := NewParser(config)
+
+	if 0 == size {
+		size = len(message)
+	}
+
+	for i := 0; i < len(message); i += size {
+		end := i + size
+		if end > len(message) {
+			end = len(message)
+		}
+
+		_, err := parser.Write([]byte(message[i:end]))
+		if nil != err {
+			return err
+		}
+	}
+
+	return parser.Close()
+}
+
+func TestParser(t *tst.T) {
+	long := strings.Repeat("a", 3*lineLimit)
+
+	examples := []struct {
+		Message  string
+		Events   []string
+		Content  map[string]string
+		Charsets map[string]Converter
+	}{
+		{
+			Message: "",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+		},
+		{
+			Message: "Subject: hello\r\n\r\nhello\r\nworld\r\n",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": "hello\r\nworld\r\n"},
+		},
+		{
+			Message: "Subject: no body\r\n",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+		},
+		{
+			Message: "Subject: bare LF\n\nhello\nworld",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": "hello\r\nworld"},
+		},
+		{
+			Message: "Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nJ=F6rg =\r\nand =E9=\r\n",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": "Jörg and é"},
+		},
+		{
+			Message: "Subject: invalid\r\n\r\nJ\xf6rg \xe2\x82\xac\r\ncaf\xc3",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": "J\ufffdrg €\r\ncaf\ufffd"},
+		},
+		{
+			Message: "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nw6nD\r\nqcOp\r\n",
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": "ééé"},
+		},
+		{
+			Message: "Content-Type: text/plain; charset=koi8-r\r\n\r\n\xc1\r\n",
+			Events:  []string{"start 0 text/plain", "end 0"},
+			Content: map[string]string{"0": "\xc1\r\n"},
+		},
+		{
+			Message:  "Content-Type: text/plain; charset=x-upper\r\n\r\nabc\r\n",
+			Events:   []string{"start 0 text/plain utf8", "end 0"},
+			Content:  map[string]string{"0": "ABC\r\n."},
+			Charsets: map[string]Converter{"x-upper": testUpperConverter{}},
+		},
+		{
+			Message: "Subject: long\r\n\r\n" + long + "\r\n" + long,
+			Events:  []string{"start 0 text/plain utf8", "end 0"},
+			Content: map[string]string{"0": long + "\r\n" + long},
+		},
+		{
+			Message: strings.Join([]string{
+				"Content-Type: multipart/mixed; boundary=\"outer\"",
+				"",
+				"preamble",
+				"--outer",
+				"Content-Type: multipart/alternative; boundary=inner",
+				"",
+				"--inner",
+				"",
+				"plain",
+				"--inner",
+				"Content-Type: text/html; charset=utf-8",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"<p>caf=C3=A9</p>",
+				"--inner--",
+				"inner epilogue",
+				"--outer  ",
+				"Content-Type: application/pdf; name=ignored.pdf",
+				"Content-Disposition: attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf",
+				"Content-Transfer-Encoding: base64",
+				"",
+				"aGVs",
+				"bG8gd29y",
+				"bGQ=",
+				"--outer",
+				"Content-Type: message/rfc822",
+				"",
+				"Subject: forwarded",
+				"Content-Type: text/plain; name=\"=?UTF-8?Q?na=C3=AFve.txt?=\"",
+				"",
+				"--outer is not the end",
+				"--outer--",
+				"epilogue",
+				"--outer",
+				"",
+			}, "\r\n"),
+			Events: []string{
+				"start 0 multipart/mixed",
+				"start 0.0 multipart/alternative",
+				"start 0.0.0 text/plain utf8",
+				"end 0.0.0",
+				"start 0.0.1 text/html utf8",
+				"end 0.0.1",
+				"end 0.0",
+				"start 0.1 application/pdf résumé.pdf",
+				"end 0.1",
+				"start 0.2 message/rfc822",
+				"start 0.2.0 text/plain naïve.txt utf8",
+				"end 0.2.0",
+				"end 0.2",
+				"end 0",
+			},
+			Content: map[string]string{
+				"0.0.0": "plain",
+				"0.0.1": "<p>café</p>",
+				"0.1":   "hello world",
+				"0.2.0": "--outer is not the end",
+			},
+		},
+		{
+			Message: "Content-Type: multipart/digest; boundary=b\r\n\r\n--b\r\n\r\nSubject: digested\r\n\r\nhello\r\n--b\r\nContent-Type: text/plain\r\n\r\nnot a message",
+			Events: []string{
+				"start 0 multipart/digest",
+				"start 0.0 message/rfc822",
+				"start 0.0.0 text/plain utf8",
+				"end 0.0.0",
+				"end 0.0",
+				"start 0.1 text/plain utf8",
+				"end 0.1",
+				"end 0",
+			},
+			Content: map[string]string{"0.0.0": "hello", "0.1": "not a message"},
+		},
+		{
+			Message: "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: message/rfc822\r\n\r\nSubject: truncated",
+			Events: []string{
+				"start 0 multipart/mixed",
+				"start 0.0 message/rfc822",
+				"start 0.0.0 text/plain utf8",
+				"end 0.0.0",
+				"end 0.0",
+				"end 0",
+			},
+		},
+		{
+			Message: "Content-Type: multipart/mixed\r\n\r\n--b\r\nhello\r\n",
+			Events:  []string{"start 0 multipart/mixed", "end 0"},
+			Content: map[string]string{"0": "--b\r\nhello\r\n"},
+		},
+	}
+
+	for _, ex := range examples {
+		for _, size := range []int{0, 1, 5} {
+			handler := &testHandler{}
+
+			config := Config{Handler: handler}
+			if nil != ex.Charsets {
+				config.Charset = func(charset string) Converter {
+					return ex.Charsets[charset]
+				}
+			}
+
+			if err := testParse(config, ex.Message, size); nil != err {
+				t.Errorf("Unexpected error for %q in pieces of %v: %v", ex.Message, size, err)
+			}
+
+			if !reflect.DeepEqual(ex.Events, handler.events) {
+				t.Errorf("Unexpected parts of %q in pieces of %v: %q", ex.Message, size, handler.events)
+			}
+
+			if (0 != len(ex.Content) || 0 != len(handler.content)) && !reflect.DeepEqual(ex.Content, handler.content) {
+				t.Errorf("Unexpected content of %q in pieces of %v: %q", ex.Message, size, handler.content)
+			}
+		}
+	}
+}
+
+type testUpperConverter struct{}
+
+func (testUpperConverter) Convert(dst, content []byte) []byte {
+	return append(dst, strings.ToUpper(string(content))...)
+}
+
+func (testUpperConverter) Finish(dst []byte) []byte {
+	return append(dst, '.')
+}
+
+func TestParserHeaderTooLarge(t *tst.T) {
+	message := "Subject: " + strings.Repeat("a", headerLimit) + "\r\n\r\nhello\r\n"
+
+	if err := testParse(Config{Handler: &testHandler{}}, message, 0); ErrHeaderTooLarge != err {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParserHandlerError(t *tst.T) {
+	rejected := errors.New("rejected")
+
+	handler := &testHandler{
+		onStart: func(part *Part) error {
+			if "application/x-msdownload" == part.MediaType {
+				return rejected
+			}
+
+			return nil
+		},
+	}
+
+	parser := NewParser(Config{Handler: handler})
+
+	_, err := parser.Write([]byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: application/x-msdownload\r\n\r\n"))
+	if rejected != err {
+		t.Errorf("Unexpected error from Write: %v", err)
+	}
+
+	if _, err := parser.Write([]byte("MZ\r\n--b--\r\n")); rejected != err {
+		t.Errorf("Unexpected error from Write after the handler failed: %v", err)
+	}
+
+	if err := parser.Close(); rejected != err {
+		t.Errorf("Unexpected error from Close: %v", err)
+	}
+
+	if 2 != len(handler.events) {
+		t.Errorf("Unexpected parts after the handler failed: %q", handler.events)
+	}
+}
+
+func TestParserDepthLimit(t *tst.T) {
+	message := ""
+	for i := 0; i < 2*depthLimit; i++ {
+		message += "Content-Type: multipart/mixed; boundary=b" + strconv.Itoa(i) + "\r\n\r\n--b" + strconv.Itoa(i) + "\r\n"
+	}
+
+	deepest := 0
+	handler := &testHandler{
+		onStart: func(part *Part) error {
+			if part.Depth > deepest {
+				deepest = part.Depth
+			}
+
+			return nil
+		},
+	}
+
+	if err := testParse(Config{Handler: handler}, message, 0); nil != err {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if depthLimit != deepest || 2*(depthLimit+1) != len(handler.events) {
+		t.Errorf("Unexpected nesting beyond the limit: depth %v, %v events", deepest, len(handler.events))
+	}
+}
@@ -0,0 +1,138 @@
+package mimeparse
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/hf/smtp"
+)
+
+// A part of a message, or the message itself.
+type Part struct {
+	// The header section of the part.
+	Header smtp.Header
+
+	// The multipart or message/rfc822 part containing the part, nil for the
+	// message itself.
+	Parent *Part
+
+	// Position of the part within its parent, from 0.
+	Index int
+
+	// Nesting depth of the part, 0 for the message itself.
+	Depth int
+
+	// Lower-cased media type from Content-Type. If unspecified or invalid it
+	// is "message/rfc822" within a multipart/digest and "text/plain"
+	// otherwise, RFC 2045 section 5.2 and RFC 2046 section 5.1.5.
+	MediaType string
+
+	// Parameters of the media type, with lower-cased names and RFC 2231
+	// continuations and encodings decoded.
+	Params map[string]string
+
+	// Lower-cased Content-Transfer-Encoding, "7bit" if unspecified.
+	Encoding string
+
+	// Lower-cased charset of a text part, "us-ascii" if unspecified. Empty for
+	// other parts.
+	Charset string
+
+	// Whether the content of the part is passed as UTF-8, which is the case
+	// for text parts in a known charset.
+	UTF8 bool
+
+	// Lower-cased disposition type from Content-Disposition, such as
+	// "attachment", or empty if unspecified.
+	Disposition string
+
+	// Decoded file name from Content-Disposition, or from the name parameter
+	// of Content-Type, if any.
+	Filename string
+}
+
+// Whether the part is a multipart with nested parts.
+func (part *Part) IsMultipart() bool {
+	return strings.HasPrefix(part.MediaType, "multipart/") && "" != part.Params["boundary"]
+}
+
+// Whether the part is a message/rfc822 or message/global part, which nests
+// the message it contains unless it has a transfer encoding.
+func (part *Part) IsMessage() bool {
+	switch part.MediaType {
+	case "message/rfc822", "message/global":
+		return identityEncoding(part.Encoding)
+
+	default:
+		return false
+	}
+}
+
+// The raw body of the first field with the name in the header, as the
+// parameters of MIME fields are not encoded-words.
+func rawField(header smtp.Header, name string) string {
+	for _, field := range header {
+		if strings.EqualFold(name, field.Name) {
+			return field.Raw
+		}
+	}
+
+	return ""
+}
+
+func newPart(header smtp.Header, parent *Part, index int) *Part {
+	part := &Part{
+		Header:    header,
+		Parent:    parent,
+		Index:     index,
+		MediaType: "text/plain",
+		Params:    map[string]string{},
+		Encoding:  "7bit",
+	}
+
+	if nil != parent {
+		part.Depth = parent.Depth + 1
+
+		if "multipart/digest" == parent.MediaType {
+			part.MediaType = "message/rfc822"
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(rawField(header, "Content-Type"))
+	if (nil == err || mime.ErrInvalidMediaParameter == err) && strings.Contains(mediaType, "/") {
+		part.MediaType = mediaType
+		part.Params = params
+	}
+
+	if encoding := rawField(header, "Content-Transfer-Encoding"); "" != encoding {
+		part.Encoding = strings.ToLower(encoding)
+	}
+
+	if strings.HasPrefix(part.MediaType, "text/") {
+		part.Charset = "us-ascii"
+
+		if charset := part.Params["charset"]; "" != charset {
+			part.Charset = strings.ToLower(charset)
+		}
+	}
+
+	disposition, dispositionParams, err := mime.ParseMediaType(rawField(header, "Content-Disposition"))
+	if nil == err || mime.ErrInvalidMediaParameter == err {
+		part.Disposition = disposition
+	}
+
+	filename := dispositionParams["filename"]
+	if "" == filename {
+		filename = part.Params["name"]
+	}
+
+	// many clients use encoded-words for file names despite RFC 2047
+	decoder := mime.WordDecoder{}
+
+	part.Filename, err = decoder.DecodeHeader(filename)
+	if nil != err {
+		part.Filename = filename
+	}
+
+	return part
+}
@@ -0,0 +1,90 @@
+package mimeparse
+
+import (
+	"reflect"
+	tst "testing"
+
+	"github.com/hf/smtp"
+)
+
+func TestNewPart(t *tst.T) {
+	digest := &Part{MediaType: "multipart/digest"}
+
+	examples := []struct {
+		Header   string
+		Parent   *Part
+		Expected Part
+	}{
+		{
+			Header: "",
+			Expected: Part{
+				MediaType: "text/plain",
+				Params:    map[string]string{},
+				Encoding:  "7bit",
+				Charset:   "us-ascii",
+			},
+		},
+		{
+			Header: "Content-Type: Text/HTML; Charset=\"ISO-8859-1\"\r\nContent-Transfer-Encoding: Quoted-Printable\r\n",
+			Expected: Part{
+				MediaType: "text/html",
+				Params:    map[string]string{"charset": "ISO-8859-1"},
+				Encoding:  "quoted-printable",
+				Charset:   "iso-8859-1",
+			},
+		},
+		{
+			Header: "Content-Type: application/octet-stream; name=\"=?UTF-8?B?w6kucGRm?=\"\r\nContent-Disposition: Attachment\r\n",
+			Expected: Part{
+				MediaType:   "application/octet-stream",
+				Params:      map[string]string{"name": "=?UTF-8?B?w6kucGRm?="},
+				Encoding:    "7bit",
+				Disposition: "attachment",
+				Filename:    "é.pdf",
+			},
+		},
+		{
+			Header: "Content-Type: invalid\r\n",
+			Parent: digest,
+			Expected: Part{
+				Parent:    digest,
+				Depth:     1,
+				MediaType: "message/rfc822",
+				Params:    map[string]string{},
+				Encoding:  "7bit",
+			},
+		},
+	}
+
+	for _, ex := range examples {
+		header := smtp.ParseHeader([]byte(ex.Header))
+
+		part := newPart(header, ex.Parent, 0)
+		part.Header = nil
+
+		if !reflect.DeepEqual(&ex.Expected, part) {
+			t.Errorf("Unexpected part for %q: %+v", ex.Header, part)
+		}
+	}
+}
+
+func TestPartNesting(t *tst.T) {
+	examples := []struct {
+		Part      Part
+		Multipart bool
+		Message   bool
+	}{
+		{Part{MediaType: "multipart/mixed", Params: map[string]string{"boundary": "b"}}, true, false},
+		{Part{MediaType: "multipart/mixed", Params: map[string]string{}}, false, false},
+		{Part{MediaType: "message/rfc822", Encoding: "7bit"}, false, true},
+		{Part{MediaType: "message/global", Encoding: "binary"}, false, true},
+		{Part{MediaType: "message/rfc822", Encoding: "base64"}, false, false},
+		{Part{MediaType: "text/plain"}, false, false},
+	}
+
+	for _, ex := range examples {
+		if ex.Multipart != ex.Part.IsMultipart() || ex.Message != ex.Part.IsMessage() {
+			t.Errorf("Unexpected nesting of %v: %v %v", ex.Part.MediaType, ex.Part.IsMultipart(), ex.Part.IsMessage())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ESMTP parameters of a MAIL or RCPT command, as specified in RFC 5321
+// section 4.1.2. Keywords are upper-cased, values are as sent by the client
+// and are the empty string for parameters without a value.
+type Params map[string]string
+
+// Whether the parameter with the keyword was sent. The keyword is
+// case-insensitive.
+func (params Params) Has(keyword string) bool {
+	_, ok := params[strings.ToUpper(keyword)]
+
+	return ok
+}
+
+// Value of the parameter with the keyword, or the empty string if it was not
+// sent. The keyword is case-insensitive.
+func (params Params) Get(keyword string) string {
+	return params[strings.ToUpper(keyword)]
+}
+
+func isEsmtpKeyword(keyword []byte) bool {
+	if 0 == len(keyword) || !isLetDig(keyword[0]) {
+		return false
+	}
+
+	for _, c := range keyword {
+		if !isLetDig(c) && '-' != c {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isEsmtpValue(value []byte) bool {
+	if 0 == len(value) {
+		return false
+	}
+
+	for _, c := range value {
+		if c < 33 || c > 126 || '=' == c {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parses the space separated esmtp-params following the path of a MAIL or
+// RCPT command. Returns false if any parameter is syntactically invalid or
+// specified more than once.
+func parseParams(input []byte) (Params, bool) {
+	params := Params{}
+
+	for _, param := range bytes.Fields(input) {
+		keyword := param
+		value := []byte(nil)
+
+		equals := bytes.IndexByte(param, '=')
+		if equals >= 0 {
+			keyword = param[:equals]
+			value = param[equals+1:]
+
+			if !isEsmtpValue(value) {
+				return nil, false
+			}
+		}
+
+		if !isEsmtpKeyword(keyword) {
+			return nil, false
+		}
+
+		name := strings.ToUpper(string(keyword))
+
+		if _, ok := params[name]; ok {
+			return nil, false
+		}
+
+		params[name] = string(value)
+	}
+
+	return params, true
+}
+
+// Decodes xtext as specified in RFC 3461 section 4. Returns false if the
+// input is not valid xtext.
+func decodeXtext(input string) (string, bool) {
+	var builder strings.Builder
+
+	for i := 0; i < len(input); i += 1 {
+		c := input[i]
+
+		switch {
+		case '+' == c:
+			if i+2 >= len(input) {
+				return "", false
+			}
+
+			hi, lo := unhexUpper(input[i+1]), unhexUpper(input[i+2])
+			if hi < 0 || lo < 0 {
+				return "", false
+			}
+
+			builder.WriteByte(byte(hi<<4 | lo))
+			i += 2
+
+		case c < 33 || c > 126 || '=' == c:
+			return "", false
+
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String(), true
+}
+
+func unhexUpper(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'A' <= c && c <= 'F':
+		return int(c-'A') + 10
+	}
+
+	return -1
+}
@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"reflect"
+	tst "testing"
+)
+
+func TestParseParams(t *tst.T) {
+	examples := map[string]Params{
+		"":                     {},
+		" ":                    {},
+		" SIZE=123":            {"SIZE": "123"},
+		" size=123  body=7BIT": {"SIZE": "123", "BODY": "7BIT"},
+		" X-ONE X-TWO=a+2Bb":   {"X-ONE": "", "X-TWO": "a+2Bb"},
+	}
+
+	for input, expected := range examples {
+		params, ok := parseParams([]byte(input))
+
+		if !ok {
+			t.Errorf("Unexpected failure for %q", input)
+		} else if !reflect.DeepEqual(expected, params) {
+			t.Errorf("Unexpected params for %q: %v", input, params)
+		}
+	}
+}
+
+func TestParseParamsInvalid(t *tst.T) {
+	inputs := []string{
+		" SIZE=",
+		" =123",
+		" -SIZE=123",
+		" SI_ZE=123",
+		" SIZE=1=2",
+		" SIZE=123 size=456",
+		" SIZE=\x7f",
+		" SIZE=\xc3\xa9",
+	}
+
+	for _, input := range inputs {
+		_, ok := parseParams([]byte(input))
+
+		if ok {
+			t.Errorf("Unexpected success for %q", input)
+		}
+	}
+}
+
+func TestParamsGet(t *tst.T) {
+	params := Params{"SIZE": "123", "X-ONE": ""}
+
+	if !params.Has("size") || "123" != params.Get("size") {
+		t.Errorf("Unexpected SIZE: %v %q", params.Has("size"), params.Get("size"))
+	}
+
+	if !params.Has("X-One") || "" != params.Get("X-One") {
+		t.Errorf("Unexpected X-ONE: %v %q", params.Has("X-One"), params.Get("X-One"))
+	}
+
+	if params.Has("BODY") {
+		t.Errorf("Unexpected BODY")
+	}
+}
+
+func TestDecodeXtext(t *tst.T) {
+	examples := map[string]string{
+		"":                       "",
+		"someone@example.com":    "someone@example.com",
+		"some+2Bone@example.com": "some+one@example.com",
+		"+3D+20+2B":              "= +",
+	}
+
+	for input, expected := range examples {
+		decoded, ok := decodeXtext(input)
+
+		if !ok || expected != decoded {
+			t.Errorf("Unexpected decoding for %q: %q %v", input, decoded, ok)
+		}
+	}
+
+	for _, input := range []string{"+", "+2", "+2b", "+ZZ", "a=b", "a b", "\xc3\xa9"} {
+		_, ok := decodeXtext(input)
+
+		if ok {
+			t.Errorf("Unexpected success for %q", input)
+		}
+	}
+}
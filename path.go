@@ -0,0 +1,415 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// A path from the MAIL or RCPT command, as specified in RFC 5321 section
+// 4.1.2. The null reverse-path "<>" has all fields empty.
+type Path struct {
+	// Source route of the path, as domains without the leading "@". Source
+	// routes are obsolete and should be ignored, see RFC 5321 appendix C.
+	Route []string
+
+	// Local part of the mailbox. If it was sent as a quoted string, this is
+	// the unquoted content.
+	LocalPart string
+
+	// Domain of the mailbox as sent, which may mix A-labels and U-labels.
+	// Empty if the mailbox uses an address literal, or if it is the special
+	// "<Postmaster>" recipient without a domain.
+	Domain string
+
+	// Address literal of the mailbox without the square brackets, such as
+	// "192.0.2.1" or "IPv6:2001:db8::1". Empty if the mailbox has a domain.
+	Literal string
+}
+
+// Whether this is the null reverse-path "<>".
+func (path Path) IsNull() bool {
+	return "" == path.LocalPart && "" == path.Domain && "" == path.Literal
+}
+
+// Whether this is the special "<Postmaster>" forward-path without a domain.
+func (path Path) IsPostmaster() bool {
+	return "" == path.Domain && "" == path.Literal && strings.EqualFold("postmaster", path.LocalPart)
+}
+
+// Whether the path is all ASCII. Paths with UTF-8 local parts or U-labels in
+// the domain are only accepted with SMTPUTF8, RFC 6531.
+func (path Path) IsASCII() bool {
+	for _, domain := range path.Route {
+		if !isASCII(domain) {
+			return false
+		}
+	}
+
+	return isASCII(path.LocalPart) && isASCII(path.Domain)
+}
+
+// The domain with all U-labels converted to A-labels, as looked up in the
+// DNS. Domains with U-labels are converted with the IDNA2008 lookup profile,
+// which also lower-cases them.
+func (path Path) DomainASCII() string {
+	if isASCII(path.Domain) {
+		return path.Domain
+	}
+
+	domain, err := idna.Lookup.ToASCII(path.Domain)
+	if nil != err {
+		return path.Domain
+	}
+
+	return domain
+}
+
+// The domain with all A-labels converted to U-labels, as displayed to users.
+// Domains with A-labels are converted with the IDNA2008 lookup profile, which
+// also lower-cases them.
+func (path Path) DomainUnicode() string {
+	if !hasALabel(path.Domain) {
+		return path.Domain
+	}
+
+	domain, err := idna.Lookup.ToUnicode(path.Domain)
+	if nil != err {
+		return path.Domain
+	}
+
+	return domain
+}
+
+// The mailbox of the path, without the source route and the angle brackets.
+// The local part is quoted if necessary.
+func (path Path) String() string {
+	if path.IsNull() {
+		return ""
+	}
+
+	local := path.LocalPart
+
+	if !isDotString(local) {
+		local = quoteLocalPart(local)
+	}
+
+	if "" != path.Literal {
+		return local + "@[" + path.Literal + "]"
+	}
+
+	if "" == path.Domain {
+		return local
+	}
+
+	return local + "@" + path.Domain
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetDig(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+// Whether the octet is atext, including the octets of UTF-8 characters from
+// RFC 6531, which must be validated separately.
+func isAtext(c byte) bool {
+	if isLetDig(c) || c >= utf8.RuneSelf {
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+func isQtextSMTP(c byte) bool {
+	return (32 <= c && c <= 33) || (35 <= c && c <= 91) || (93 <= c && c <= 126) || c >= utf8.RuneSelf
+}
+
+func isDcontent(c byte) bool {
+	return (33 <= c && c <= 90) || (94 <= c && c <= 126)
+}
+
+func isDotString(str string) bool {
+	if "" == str || !utf8.ValidString(str) {
+		return false
+	}
+
+	atom := 0
+
+	for i := 0; i < len(str); i += 1 {
+		if '.' == str[i] {
+			if 0 == atom {
+				return false
+			}
+
+			atom = 0
+		} else if isAtext(str[i]) {
+			atom += 1
+		} else {
+			return false
+		}
+	}
+
+	return atom > 0
+}
+
+func quoteLocalPart(local string) string {
+	var builder strings.Builder
+
+	builder.WriteByte('"')
+
+	for i := 0; i < len(local); i += 1 {
+		if '"' == local[i] || '\\' == local[i] {
+			builder.WriteByte('\\')
+		}
+
+		builder.WriteByte(local[i])
+	}
+
+	builder.WriteByte('"')
+
+	return builder.String()
+}
+
+// Scans a Domain, returning its length or 0 if there is none. Sub-domains
+// may be U-labels, RFC 6531.
+func scanDomain(input []byte) int {
+	i := 0
+
+	for {
+		start := i
+
+		for i < len(input) && (isLetDig(input[i]) || '-' == input[i] || input[i] >= utf8.RuneSelf) {
+			i += 1
+		}
+
+		if start == i {
+			return 0
+		}
+
+		if i < len(input) && '.' == input[i] {
+			i += 1
+			continue
+		}
+
+		if !isDomain(string(input[:i])) {
+			return 0
+		}
+
+		return i
+	}
+}
+
+// Scans an address-literal starting with "[", returning its length or 0 if
+// it is not valid.
+func scanAddressLiteral(input []byte) int {
+	end := -1
+
+	for i := 1; i < len(input); i += 1 {
+		if ']' == input[i] {
+			end = i
+			break
+		}
+
+		if !isDcontent(input[i]) {
+			return 0
+		}
+	}
+
+	if end < 0 {
+		return 0
+	}
+
+	literal := string(input[1:end])
+
+	if 0 == len(literal) {
+		return 0
+	}
+
+	if isDigit(literal[0]) {
+		ip := net.ParseIP(literal)
+
+		if nil == ip || nil == ip.To4() || strings.Contains(literal, ":") {
+			return 0
+		}
+
+		return end + 1
+	}
+
+	colon := strings.IndexByte(literal, ':')
+	if colon <= 0 || colon == len(literal)-1 {
+		return 0
+	}
+
+	tag := literal[:colon]
+
+	if strings.EqualFold("IPv6", tag) {
+		ip := net.ParseIP(literal[colon+1:])
+
+		if nil == ip || !strings.Contains(literal[colon+1:], ":") {
+			return 0
+		}
+
+		return end + 1
+	}
+
+	// General-address-literal, the tag is an Ldh-str
+	for i := 0; i < len(tag); i += 1 {
+		if !isLetDig(tag[i]) && '-' != tag[i] {
+			return 0
+		}
+	}
+
+	if '-' == tag[len(tag)-1] {
+		return 0
+	}
+
+	return end + 1
+}
+
+// Parses a path or the null reverse-path at the start of the input. On
+// success, returns the parsed path, the mailbox part of the input as it was
+// sent, and the input after the closing ">".
+func parsePath(input []byte) (Path, []byte, []byte, bool) {
+	path := Path{}
+
+	if len(input) < 2 || '<' != input[0] {
+		return path, nil, nil, false
+	}
+
+	i := 1
+
+	if '>' == input[i] {
+		return path, input[i:i], input[i+1:], true
+	}
+
+	if '@' == input[i] {
+		// A-d-l ":"
+		for {
+			if i >= len(input) || '@' != input[i] {
+				return path, nil, nil, false
+			}
+
+			i += 1
+
+			n := scanDomain(input[i:])
+			if 0 == n {
+				return path, nil, nil, false
+			}
+
+			path.Route = append(path.Route, string(input[i:i+n]))
+			i += n
+
+			if i < len(input) && ',' == input[i] {
+				i += 1
+				continue
+			}
+
+			if i < len(input) && ':' == input[i] {
+				i += 1
+				break
+			}
+
+			return path, nil, nil, false
+		}
+	}
+
+	mailbox := i
+
+	if i < len(input) && '"' == input[i] {
+		var local strings.Builder
+
+		i += 1
+
+		for {
+			if i >= len(input) {
+				return path, nil, nil, false
+			}
+
+			c := input[i]
+
+			if '"' == c {
+				i += 1
+				break
+			}
+
+			if '\\' == c {
+				if i+1 >= len(input) || input[i+1] < 32 || input[i+1] > 126 {
+					return path, nil, nil, false
+				}
+
+				local.WriteByte(input[i+1])
+				i += 2
+				continue
+			}
+
+			if !isQtextSMTP(c) {
+				return path, nil, nil, false
+			}
+
+			local.WriteByte(c)
+			i += 1
+		}
+
+		path.LocalPart = local.String()
+
+		if !utf8.ValidString(path.LocalPart) {
+			return path, nil, nil, false
+		}
+	} else {
+		start := i
+
+		for i < len(input) && (isAtext(input[i]) || '.' == input[i]) {
+			i += 1
+		}
+
+		path.LocalPart = string(input[start:i])
+
+		if !isDotString(path.LocalPart) {
+			return path, nil, nil, false
+		}
+	}
+
+	// "<Postmaster>" is the only mailbox allowed without a domain
+	if i < len(input) && '>' == input[i] && nil == path.Route && '"' != input[mailbox] && path.IsPostmaster() {
+		return path, input[mailbox:i], input[i+1:], true
+	}
+
+	if i >= len(input) || '@' != input[i] {
+		return path, nil, nil, false
+	}
+
+	i += 1
+
+	if i < len(input) && '[' == input[i] {
+		n := scanAddressLiteral(input[i:])
+		if 0 == n {
+			return path, nil, nil, false
+		}
+
+		path.Literal = string(input[i+1 : i+n-1])
+		i += n
+	} else {
+		n := scanDomain(input[i:])
+		if 0 == n {
+			return path, nil, nil, false
+		}
+
+		path.Domain = string(input[i : i+n])
+		i += n
+	}
+
+	if i >= len(input) || '>' != input[i] {
+		return path, nil, nil, false
+	}
+
+	return path, input[mailbox:i], input[i+1:], true
+}
@@ -0,0 +1,232 @@
+package smtp
+
+import (
+	"reflect"
+	tst "testing"
+)
+
+func TestParsePath(t *tst.T) {
+	examples := map[string]struct {
+		Path   Path
+		Addr   string
+		Rest   string
+		String string
+	}{
+		"<>": {
+			Path: Path{},
+		},
+		"<someone@example.com>": {
+			Path: Path{
+				LocalPart: "someone",
+				Domain:    "example.com",
+			},
+			Addr:   "someone@example.com",
+			String: "someone@example.com",
+		},
+		"<some.one+tag@mail-1.example.com> SIZE=123": {
+			Path: Path{
+				LocalPart: "some.one+tag",
+				Domain:    "mail-1.example.com",
+			},
+			Addr:   "some.one+tag@mail-1.example.com",
+			Rest:   " SIZE=123",
+			String: "some.one+tag@mail-1.example.com",
+		},
+		"<\"some>one\"@example.com>": {
+			Path: Path{
+				LocalPart: "some>one",
+				Domain:    "example.com",
+			},
+			Addr:   "\"some>one\"@example.com",
+			String: "\"some>one\"@example.com",
+		},
+		"<\"some \\\"one\\\\\"@example.com>": {
+			Path: Path{
+				LocalPart: "some \"one\\",
+				Domain:    "example.com",
+			},
+			Addr:   "\"some \\\"one\\\\\"@example.com",
+			String: "\"some \\\"one\\\\\"@example.com",
+		},
+		"<\"someone\"@example.com>": {
+			Path: Path{
+				LocalPart: "someone",
+				Domain:    "example.com",
+			},
+			Addr:   "\"someone\"@example.com",
+			String: "someone@example.com",
+		},
+		"<someone@[192.0.2.1]>": {
+			Path: Path{
+				LocalPart: "someone",
+				Literal:   "192.0.2.1",
+			},
+			Addr:   "someone@[192.0.2.1]",
+			String: "someone@[192.0.2.1]",
+		},
+		"<someone@[IPv6:2001:db8::1]>": {
+			Path: Path{
+				LocalPart: "someone",
+				Literal:   "IPv6:2001:db8::1",
+			},
+			Addr:   "someone@[IPv6:2001:db8::1]",
+			String: "someone@[IPv6:2001:db8::1]",
+		},
+		"<someone@[x-tag:anything]>": {
+			Path: Path{
+				LocalPart: "someone",
+				Literal:   "x-tag:anything",
+			},
+			Addr:   "someone@[x-tag:anything]",
+			String: "someone@[x-tag:anything]",
+		},
+		"<@a.example.com,@b.example.com:someone@example.com>": {
+			Path: Path{
+				Route:     []string{"a.example.com", "b.example.com"},
+				LocalPart: "someone",
+				Domain:    "example.com",
+			},
+			Addr:   "someone@example.com",
+			String: "someone@example.com",
+		},
+		"<Postmaster>": {
+			Path: Path{
+				LocalPart: "Postmaster",
+			},
+			Addr:   "Postmaster",
+			String: "Postmaster",
+		},
+	}
+
+	for input, ex := range examples {
+		path, addr, rest, ok := parsePath([]byte(input))
+
+		if !ok {
+			t.Errorf("Unexpected failure for %q", input)
+			continue
+		}
+
+		if !reflect.DeepEqual(ex.Path, path) {
+			t.Errorf("Unexpected path for %q: %#v", input, path)
+		}
+
+		if ex.Addr != string(addr) || nil == addr {
+			t.Errorf("Unexpected addr for %q: %q", input, addr)
+		}
+
+		if ex.Rest != string(rest) {
+			t.Errorf("Unexpected rest for %q: %q", input, rest)
+		}
+
+		if ex.String != path.String() {
+			t.Errorf("Unexpected string for %q: %q", input, path.String())
+		}
+	}
+}
+
+func TestParsePathInvalid(t *tst.T) {
+	inputs := []string{
+		"",
+		"<",
+		"someone@example.com",
+		"<someone@example.com",
+		"<some one@example.com>",
+		"<someone>",
+		"<\"postmaster\">",
+		"<someone@>",
+		"<@example.com>",
+		"<.someone@example.com>",
+		"<some..one@example.com>",
+		"<someone.@example.com>",
+		"<someone@example..com>",
+		"<someone@example.com.>",
+		"<someone@-example.com>",
+		"<someone@example-.com>",
+		"<someone@exa_mple.com>",
+		"<\"some\"one\"@example.com>",
+		"<\"someone@example.com>",
+		"<someone@[192.0.2.256]>",
+		"<someone@[192.0.2]>",
+		"<someone@[IPv6:192.0.2.1]>",
+		"<someone@[IPv6:zz::1]>",
+		"<someone@[]>",
+		"<someone@[x-tag:]>",
+		"<someone@[192.0.2.1>",
+		"<@a.example.com someone@example.com>",
+		"<@a.example.com,someone@example.com>",
+		"<someone@example.com@example.com>",
+		"<some\xffone@example.com>",
+	}
+
+	for _, input := range inputs {
+		_, _, _, ok := parsePath([]byte(input))
+
+		if ok {
+			t.Errorf("Unexpected success for %q", input)
+		}
+	}
+}
+
+func TestPathUTF8(t *tst.T) {
+	examples := map[string]struct {
+		Path          Path
+		ASCII         bool
+		DomainASCII   string
+		DomainUnicode string
+	}{
+		"<someone@example.com>": {
+			Path:          Path{LocalPart: "someone", Domain: "example.com"},
+			ASCII:         true,
+			DomainASCII:   "example.com",
+			DomainUnicode: "example.com",
+		},
+		"<jöran@bücher.example>": {
+			Path:          Path{LocalPart: "jöran", Domain: "bücher.example"},
+			DomainASCII:   "xn--bcher-kva.example",
+			DomainUnicode: "bücher.example",
+		},
+		"<someone@xn--bcher-kva.example>": {
+			Path:          Path{LocalPart: "someone", Domain: "xn--bcher-kva.example"},
+			ASCII:         true,
+			DomainASCII:   "xn--bcher-kva.example",
+			DomainUnicode: "bücher.example",
+		},
+		"<\"用 户\"@例子.广告>": {
+			Path:          Path{LocalPart: "用 户", Domain: "例子.广告"},
+			DomainASCII:   "xn--fsqu00a.xn--4rr70v",
+			DomainUnicode: "例子.广告",
+		},
+	}
+
+	for input, ex := range examples {
+		path, _, _, ok := parsePath([]byte(input))
+		if !ok {
+			t.Errorf("Unexpected failure for %q", input)
+			continue
+		}
+
+		if !reflect.DeepEqual(ex.Path, path) {
+			t.Errorf("Unexpected path for %q: %#v", input, path)
+		}
+
+		if ex.ASCII != path.IsASCII() {
+			t.Errorf("Unexpected IsASCII for %q", input)
+		}
+
+		if ex.DomainASCII != path.DomainASCII() || ex.DomainUnicode != path.DomainUnicode() {
+			t.Errorf("Unexpected domains for %q: %q %q", input, path.DomainASCII(), path.DomainUnicode())
+		}
+	}
+
+	for _, input := range []string{
+		"<someone@BÜCHER.example>",
+		"<someone@ab--cd.example>",
+		"<someone@xn--bcher-kv.example>",
+		"<\"some\xffone\"@example.com>",
+		"<someone@bü\xffcher.example>",
+	} {
+		if _, _, _, ok := parsePath([]byte(input)); ok {
+			t.Errorf("Unexpected success for %q", input)
+		}
+	}
+}
@@ -1,57 +1,178 @@
 package smtp
 
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// A SMTP reply with a three digit code and one or more lines of text.
+//
+// A Reply is also an error, so that Envelope methods can return one, or a
+// pointer to one, to be sent to the client instead of the reply for the
+// returned action.
+type Reply struct {
+	Code int
+
+	// Enhanced status code of the reply, such as "5.1.1", prefixed to every
+	// line as specified in RFC 2034. Empty for replies without one, such as
+	// the greeting or the reply to EHLO.
+	Enhanced string
+
+	Lines []string
+}
+
+// Replaces CR and LF, so that text cannot end a reply line early and inject
+// lines of its own.
+var replyLineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// The reply as sent to the client. Any CR or LF in the enhanced status code or
+// the lines is sent as a space.
+func (reply Reply) Bytes() []byte {
+	code := strconv.Itoa(reply.Code)
+	reply.Enhanced = replyLineBreaks.Replace(reply.Enhanced)
+
+	if 0 == len(reply.Lines) {
+		if "" != reply.Enhanced {
+			return []byte(code + " " + reply.Enhanced + "\r\n")
+		}
+
+		return []byte(code + "\r\n")
+	}
+
+	var builder strings.Builder
+
+	for i, line := range reply.Lines {
+		builder.WriteString(code)
+
+		if i == len(reply.Lines)-1 {
+			builder.WriteByte(' ')
+		} else {
+			builder.WriteByte('-')
+		}
+
+		if "" != reply.Enhanced {
+			builder.WriteString(reply.Enhanced)
+			builder.WriteByte(' ')
+		}
+
+		builder.WriteString(replyLineBreaks.Replace(line))
+		builder.WriteString("\r\n")
+	}
+
+	return []byte(builder.String())
+}
+
+// The reply on a single line, such as "550 5.1.1 one; two".
+func (reply Reply) Error() string {
+	text := strconv.Itoa(reply.Code)
+
+	if "" != reply.Enhanced {
+		text += " " + reply.Enhanced
+	}
+
+	if len(reply.Lines) > 0 {
+		text += " " + strings.Join(reply.Lines, "; ")
+	}
+
+	return text
+}
+
+// Whether the reply is a positive completion or intermediate reply, with a
+// 2xx or 3xx code.
+func (reply Reply) positive() bool {
+	return reply.Code < 400
+}
+
+func newReply(code int, enhanced string, lines ...string) Reply {
+	return Reply{
+		Code:     code,
+		Enhanced: enhanced,
+		Lines:    lines,
+	}
+}
+
+var (
+	replyAnyOk               = newReply(250, "2.0.0", "Requested mail action okay, completed")
+	replyAnyBadCommand       = newReply(500, "5.5.2", "Syntax error, command unrecognized")
+	replyAnyBadSequence      = newReply(503, "5.5.1", "Bad sequence of commands")
+	replyAnyNotImplemented   = newReply(502, "5.5.1", "Command not implemented")
+	replyAnyTemporaryFailure = newReply(421, "4.3.0", "Temporary failure")
+	replyAnyBadParams        = newReply(501, "5.5.4", "Syntax error in parameters or arguments")
+	replyAnyUnknownParams    = newReply(555, "5.5.4", "MAIL FROM/RCPT TO parameters not recognized or not implemented")
+	replyAnyLineTooLong      = newReply(500, "5.5.2", "Line too long")
+	replyAnyBareLineEnding   = newReply(500, "5.5.2", "Bare CR or LF not allowed")
+)
+
 var (
-	replyAnyOk               = []byte("250 Requested mail action okay, completed\r\n")
-	replyAnyBadCommand       = []byte("500 Syntax error, command unrecognized\r\n")
-	replyAnyBadSequence      = []byte("503 Bad sequence of commands\r\n")
-	replyAnyNotImplemented   = []byte("502 Command not implemented\r\n")
-	replyAnyTemporaryFailure = []byte("421 Temporary failure\r\n")
+	replyMAILOk                  = newReply(250, "2.1.0", "Requested mail action okay, completed")
+	replyMAILBadSyntax           = newReply(501, "5.1.7", "Bad sender address syntax")
+	replyMAILNonASCII            = newReply(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+	replyMAILRejectFROMPermanent = newReply(550, "5.7.1", "Requested action not taken: sender is blocked")
+	replyMAILRejectFROMTemporary = newReply(450, "4.7.1", "Requested mail action not taken: temporarily blocked")
+	replyMAILRejectSIZEPermanent = newReply(552, "5.3.4", "message size exceeds fixed maximium message size")
+	replyMAILRejectSIZETemporary = newReply(452, "4.3.1", "insufficient system storage")
 )
 
 var (
-	replyMAILRejectFROMPermanent = []byte("550 Requested action not taken: sender is blocked\r\n")
-	replyMAILRejectFROMTemporary = []byte("450 Requested mail action not taken: temporarily blocked\r\n")
-	replyMAILRejectSIZEPermanent = []byte("552 message size exceeds fixed maximium message size\r\n")
-	replyMAILRejectSIZETemporary = []byte("452 insufficient system storage\r\n")
+	replyRCPTOk              = newReply(250, "2.1.5", "Requested mail action okay, completed")
+	replyRCPTBadSyntax       = newReply(501, "5.1.3", "Bad destination mailbox address syntax")
+	replyRCPTNonASCII        = newReply(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+	replyRCPTRejectPermanent = newReply(550, "5.1.1", "Requested action not taken: mailbox unavailable")
+	replyRCPTRejectTemporary = newReply(450, "4.2.1", "Requested mail action not taken: mailbox unavailable")
 )
 
 var (
-	replyRCPTRejectPermanent = []byte("550 Requested action not taken: mailbox unavailable\r\n")
-	replyRCPTRejectTemporary = []byte("450 Requested mail action not taken: mailbox unavailable\r\n")
+	replyDATAContinue               = newReply(354, "", "Start mail input; end with <CRLF>.<CRLF>")
+	replyDATABinaryMIME             = newReply(503, "5.5.1", "BINARYMIME content must be sent with BDAT")
+	replyDATATransactionFailed      = newReply(554, "5.0.0", "Transaction failed")
+	replyDATALineTooLong            = newReply(554, "5.6.0", "Transaction failed: line too long")
+	replyDATABareLineEnding         = newReply(554, "5.5.2", "Transaction failed: bare CR or LF not allowed")
+	replyDATARejectLoop             = newReply(554, "5.4.6", "Transaction failed: routing loop detected")
+	replyDATAHeaderTooLarge         = newReply(552, "5.3.4", "Requested mail action aborted: header section too large")
+	replyDATARejectNumberRecipients = newReply(452, "4.5.3", "Requested action not taken: too many recipients")
+	replyDATARejectPermanent        = newReply(550, "5.7.0", "Requested action not taken: mailbox unavailable")
+	replyDATARejectTemporary        = newReply(450, "4.7.0", "Requested mail action not taken: mailbox unavailable")
+	replyDATARejectSizePermanent    = newReply(552, "5.3.4", "Requested mail action aborted: exceeded storage allocation")
+	replyDATARejectSizeTemporary    = newReply(452, "4.3.1", "Requested action not taken: insufficient system storage")
 )
 
 var (
-	replyDATAContinue               = []byte("354 Start mail input; end with <CRLF>.<CRLF>\r\n")
-	replyDATATransactionFailed      = []byte("554 Transaction failed\r\n")
-	replyDATARejectNumberRecipients = []byte("452 Requested action not taken: too many recipients\r\n")
-	replyDATARejectPermanent        = []byte("550 Requested action not taken: mailbox unavailable\r\n")
-	replyDATARejectTemporary        = []byte("450 Requested mail action not taken: mailbox unavailable\r\n")
-	replyDATARejectSizePermanent    = []byte("552 Requested mail action aborted: exceeded storage allocation\r\n")
-	replyDATARejectSizeTemporary    = []byte("452 Requested action not taken: insufficient system storage\r\n")
+	replySTARTTLSReady       = newReply(220, "2.0.0", "Ready to start TLS")
+	replySTARTTLSUnavailable = newReply(454, "4.7.0", "TLS not available due to temporary reason")
+	replySTARTTLSRequired    = newReply(530, "5.7.0", "Must issue a STARTTLS command first")
 )
 
 var (
-	replySTARTTLSReady       = []byte("220 Ready to start TLS\r\n")
-	replySTARTTLSUnavailable = []byte("454 TLS not available due to temporary reason\r\n")
-	replySTARTTLSRequired    = []byte("530 Must issue a STARTTLS command first\r\n")
+	replyAUTHSucceeded             = newReply(235, "2.7.0", "Authentication successful")
+	replyAUTHFailed                = newReply(535, "5.7.8", "Authentication credentials invalid")
+	replyAUTHMalformed             = newReply(501, "5.5.2", "Cannot decode response")
+	replyAUTHCancelled             = newReply(501, "5.0.0", "Authentication cancelled")
+	replyAUTHUnrecognizedMechanism = newReply(504, "5.5.4", "Unrecognized authentication type")
+	replyAUTHEncryptionRequired    = newReply(538, "5.7.11", "Encryption required for requested authentication mechanism")
+	replyAUTHTemporaryFailure      = newReply(454, "4.7.0", "Temporary authentication failure")
 )
 
-func replyServiceReady(domain string) []byte {
-	return []byte("220 " + domain + " Service ready\r\n")
+func replyAUTHChallenge(challenge []byte) Reply {
+	return newReply(334, "", base64.StdEncoding.EncodeToString(challenge))
 }
 
-func replyServiceClosing(domain string) []byte {
-	return []byte("221 " + domain + " Service closing transmission channel\r\n")
+func replyBDATOk(size uint64) Reply {
+	return newReply(250, "2.0.0", strconv.FormatUint(size, 10)+" octets received")
 }
 
-func replyServiceNotAvailable(domain string) []byte {
-	return []byte("421 " + domain + " Service not available, closing transmission channel\r\n")
+func replyServiceReady(domain string) Reply {
+	return newReply(220, "", domain+" Service ready")
 }
 
-func replyEHLOOk(domain string, extensions string) []byte {
-	if "" == extensions {
-		return []byte("250 " + domain + " greetings\r\n")
-	}
+func replyServiceClosing(domain string) Reply {
+	return newReply(221, "2.0.0", domain+" Service closing transmission channel")
+}
+
+func replyServiceNotAvailable(domain string) Reply {
+	return newReply(421, "4.3.2", domain+" Service not available, closing transmission channel")
+}
 
-	return []byte("250-" + domain + " greetings\r\n" + extensions)
+func replyEHLOOk(domain string, extensions []string) Reply {
+	return newReply(250, "", append([]string{domain + " greetings"}, extensions...)...)
 }
@@ -8,28 +8,28 @@ import (
 func TestReplyEHLOOk(t *tst.T) {
 	examples := []struct {
 		Domain     string
-		Extensions string
+		Extensions []string
 		Expected   string
 	}{
 		{
 			Domain:     "example.com",
-			Extensions: "250 one\r\n",
+			Extensions: []string{"one"},
 			Expected:   "250-example.com greetings\r\n250 one\r\n",
 		},
 		{
 			Domain:     "example.com",
-			Extensions: "250-one\r\n250 two\r\n",
+			Extensions: []string{"one", "two"},
 			Expected:   "250-example.com greetings\r\n250-one\r\n250 two\r\n",
 		},
 		{
 			Domain:     "example.com",
-			Extensions: "",
+			Extensions: nil,
 			Expected:   "250 example.com greetings\r\n",
 		},
 	}
 
 	for _, ex := range examples {
-		reply := replyEHLOOk(ex.Domain, ex.Extensions)
+		reply := replyEHLOOk(ex.Domain, ex.Extensions).Bytes()
 
 		if !bytes.Equal([]byte(ex.Expected), reply) {
 			t.Errorf("Unexpected reply for example %q: %q", ex.Expected, reply)
@@ -38,8 +38,8 @@ func TestReplyEHLOOk(t *tst.T) {
 }
 
 func TestReplyserviceNotAvailable(t *tst.T) {
-	example := []byte("421 example.com Service not available, closing transmission channel\r\n")
-	reply := replyServiceNotAvailable("example.com")
+	example := []byte("421 4.3.2 example.com Service not available, closing transmission channel\r\n")
+	reply := replyServiceNotAvailable("example.com").Bytes()
 
 	if !bytes.Equal(example, reply) {
 		t.Errorf("Unexpected reply for example %q: %q", example, reply)
@@ -48,7 +48,7 @@ func TestReplyserviceNotAvailable(t *tst.T) {
 
 func TestReplyServiceReady(t *tst.T) {
 	example := []byte("220 example.com Service ready\r\n")
-	reply := replyServiceReady("example.com")
+	reply := replyServiceReady("example.com").Bytes()
 
 	if !bytes.Equal(example, reply) {
 		t.Errorf("Unexpected reply for example %q: %q", example, reply)
@@ -56,10 +56,65 @@ func TestReplyServiceReady(t *tst.T) {
 }
 
 func TestReplyServiceClosing(t *tst.T) {
-	example := []byte("221 example.com Service closing transmission channel\r\n")
-	reply := replyServiceClosing("example.com")
+	example := []byte("221 2.0.0 example.com Service closing transmission channel\r\n")
+	reply := replyServiceClosing("example.com").Bytes()
 
 	if !bytes.Equal(example, reply) {
 		t.Errorf("Unexpected reply for example %q: %q", example, reply)
 	}
 }
+
+func TestReplyBytes(t *tst.T) {
+	examples := []struct {
+		Reply    Reply
+		Expected string
+	}{
+		{
+			Reply:    Reply{Code: 250},
+			Expected: "250\r\n",
+		},
+		{
+			Reply:    Reply{Code: 250, Lines: []string{"one"}},
+			Expected: "250 one\r\n",
+		},
+		{
+			Reply:    Reply{Code: 550, Lines: []string{"one", "two", "three"}},
+			Expected: "550-one\r\n550-two\r\n550 three\r\n",
+		},
+		{
+			Reply:    Reply{Code: 250, Enhanced: "2.0.0"},
+			Expected: "250 2.0.0\r\n",
+		},
+		{
+			Reply:    Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"one", "two"}},
+			Expected: "550-5.1.1 one\r\n550 5.1.1 two\r\n",
+		},
+		{
+			Reply:    Reply{Code: 550, Enhanced: "5.1.1\r\n", Lines: []string{"one\r\n250 two", "three\n"}},
+			Expected: "550-5.1.1   one  250 two\r\n550 5.1.1   three \r\n",
+		},
+	}
+
+	for _, ex := range examples {
+		reply := ex.Reply.Bytes()
+
+		if !bytes.Equal([]byte(ex.Expected), reply) {
+			t.Errorf("Unexpected reply for example %q: %q", ex.Expected, reply)
+		}
+	}
+}
+
+func TestReplyError(t *tst.T) {
+	examples := map[string]Reply{
+		"250":                {Code: 250},
+		"250 2.0.0":          {Code: 250, Enhanced: "2.0.0"},
+		"451 try again":      {Code: 451, Lines: []string{"try again"}},
+		"550 5.1.1 one; two": {Code: 550, Enhanced: "5.1.1", Lines: []string{"one", "two"}},
+	}
+
+	for expected, reply := range examples {
+		if expected != reply.Error() {
+			t.Errorf("Unexpected error for example %q: %q", expected, reply.Error())
+		}
+	}
+}
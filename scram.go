@@ -0,0 +1,365 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// Salted SCRAM-SHA-256 credentials of a user, as specified in RFC 5802
+// section 3. Store these instead of the password.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// Derives the SCRAM-SHA-256 credentials from a password. The password should
+// already be prepared with SASLprep.
+func NewSCRAMSHA256Credentials(password string, salt []byte, iterations int) SCRAMCredentials {
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, iterations)
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(saltedPassword, []byte("Server Key")),
+	}
+}
+
+// Looks up the stored credentials of users for the SCRAM mechanisms.
+type CredentialStore interface {
+	// SCRAM-SHA-256 credentials of the user. Return ErrAuthFailed if the user
+	// is unknown, any other error fails the authentication temporarily. The
+	// exchange with an unknown user continues with made-up credentials and
+	// only fails at the proof, so that users cannot be enumerated.
+	SCRAMSHA256(ctx context.Context, sess *Session, username string) (SCRAMCredentials, error)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// PBKDF2 with HMAC-SHA-256 producing a single block, i.e. Hi from RFC 5802.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	block := make([]byte, len(salt)+4)
+	copy(block, salt)
+	binary.BigEndian.PutUint32(block[len(salt):], 1)
+
+	u := hmacSHA256(password, block)
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i += 1 {
+		u = hmacSHA256(password, u)
+
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+// Label of the tls-exporter channel binding, RFC 9266.
+const tlsExporterLabel = "EXPORTER-Channel-Binding"
+
+func tlsExporter(sess *Session) ([]byte, bool) {
+	state := sess.TLSConnectionState()
+	if nil == state {
+		return nil, false
+	}
+
+	data, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, 32)
+	if nil != err {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// Creates the SCRAM-SHA-256 mechanism (RFC 7677), or SCRAM-SHA-256-PLUS with
+// tls-exporter channel binding (RFC 9266) if plus is set, looking up the
+// credentials of users in the store. The PLUS variant is only available on
+// TLS connections which support exporting keying material. An authorization
+// identity different from the username is rejected.
+func NewSCRAMSHA256Mechanism(store CredentialStore, plus bool) Mechanism {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+
+	return &scramMechanism{
+		store:  store,
+		plus:   plus,
+		secret: secret,
+	}
+}
+
+type scramMechanism struct {
+	store CredentialStore
+	plus  bool
+
+	// key deriving the made-up salts of unknown users
+	secret []byte
+}
+
+// Iteration count offered to unknown users, the minimum of RFC 7677.
+const scramUnknownIterations = 4096
+
+// Made-up credentials of an unknown user, with a salt that stays the same
+// for the user as long as the mechanism, RFC 5802 section 5.1. They have no
+// keys, so no proof matches them.
+func (mech *scramMechanism) unknownCredentials(username string) SCRAMCredentials {
+	return SCRAMCredentials{
+		Salt:       hmacSHA256(mech.secret, []byte(username))[:16],
+		Iterations: scramUnknownIterations,
+	}
+}
+
+func (mech *scramMechanism) Name() string {
+	if mech.plus {
+		return "SCRAM-SHA-256-PLUS"
+	}
+
+	return "SCRAM-SHA-256"
+}
+
+func (mech *scramMechanism) Available(sess *Session) bool {
+	if !mech.plus {
+		return true
+	}
+
+	_, ok := tlsExporter(sess)
+
+	return ok
+}
+
+func (mech *scramMechanism) Start(ctx context.Context, sess *Session) MechanismExchange {
+	return &scramExchange{
+		mech: mech,
+		sess: sess,
+	}
+}
+
+type scramExchange struct {
+	mech *scramMechanism
+	sess *Session
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	username        string
+	credentials     SCRAMCredentials
+	unknown         bool
+
+	serverSignature []byte
+}
+
+// Decodes a saslname, where "=2C" and "=3D" stand for "," and "=".
+func decodeSaslname(name string) (string, bool) {
+	var builder strings.Builder
+
+	for i := 0; i < len(name); i += 1 {
+		if '=' != name[i] {
+			builder.WriteByte(name[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			builder.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			builder.WriteByte('=')
+		default:
+			return "", false
+		}
+
+		i += 2
+	}
+
+	return builder.String(), true
+}
+
+// Whether the session offers a SCRAM-SHA-256-PLUS mechanism.
+func (sess *Session) offersSCRAMPlus() bool {
+	for _, mech := range sess.mechanisms() {
+		if "SCRAM-SHA-256-PLUS" == mech.Name() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (exch *scramExchange) Next(ctx context.Context, response []byte) ([]byte, bool, string, error) {
+	switch {
+	case nil == response:
+		return []byte{}, false, "", nil
+
+	case "" == exch.serverFirst:
+		return exch.clientFirst(ctx, string(response))
+
+	case nil == exch.serverSignature:
+		return exch.clientFinal(ctx, string(response))
+	}
+
+	// the client acknowledges the server-final-message with an empty response
+	if 0 != len(response) {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	return nil, true, exch.username, nil
+}
+
+func (exch *scramExchange) clientFirst(ctx context.Context, message string) ([]byte, bool, string, error) {
+	// gs2-cbind-flag "," [authzid] "," [reserved-mext ","] username "," nonce ["," extensions]
+	parts := strings.Split(message, ",")
+	if len(parts) < 4 {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	switch {
+	case "n" == parts[0]:
+		if exch.mech.plus {
+			return nil, false, "", ErrAuthFailed
+		}
+
+	case "y" == parts[0]:
+		// the client supports channel binding, but thinks we do not
+		if exch.mech.plus || exch.sess.offersSCRAMPlus() {
+			return nil, false, "", ErrAuthFailed
+		}
+
+	case "p=tls-exporter" == parts[0]:
+		if !exch.mech.plus {
+			return nil, false, "", ErrAuthFailed
+		}
+
+	default:
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	username := ""
+
+	if "" != parts[1] {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, "", ErrAuthMalformed
+		}
+
+		authzid, ok := decodeSaslname(parts[1][2:])
+		if !ok {
+			return nil, false, "", ErrAuthMalformed
+		}
+
+		username = authzid
+	}
+
+	if strings.HasPrefix(parts[2], "m=") {
+		// mandatory extensions are not supported
+		return nil, false, "", ErrAuthFailed
+	}
+
+	if !strings.HasPrefix(parts[2], "n=") || !strings.HasPrefix(parts[3], "r=") || len(parts[3]) < 3 {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	name, ok := decodeSaslname(parts[2][2:])
+	if !ok || "" == name {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	if "" != username && username != name {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	credentials, err := exch.mech.store.SCRAMSHA256(ctx, exch.sess, name)
+	switch {
+	case ErrAuthFailed == err:
+		credentials = exch.mech.unknownCredentials(name)
+		exch.unknown = true
+
+	case nil != err:
+		return nil, false, "", err
+	}
+
+	exch.username = name
+	exch.credentials = credentials
+	exch.gs2Header = parts[0] + "," + parts[1] + ","
+	exch.clientFirstBare = message[len(exch.gs2Header):]
+	exch.nonce = parts[3][2:] + generateID()
+	exch.serverFirst = "r=" + exch.nonce + ",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) + ",i=" + strconv.Itoa(credentials.Iterations)
+
+	return []byte(exch.serverFirst), false, "", nil
+}
+
+func (exch *scramExchange) clientFinal(ctx context.Context, message string) ([]byte, bool, string, error) {
+	// channel-binding "," nonce ["," extensions] "," proof
+	proofStart := strings.LastIndex(message, ",p=")
+	if proofStart < 0 {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	withoutProof := message[:proofStart]
+
+	parts := strings.Split(withoutProof, ",")
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "c=") || !strings.HasPrefix(parts[1], "r=") {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	binding, err := base64.StdEncoding.DecodeString(parts[0][2:])
+	if nil != err {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	expectedBinding := []byte(exch.gs2Header)
+
+	if exch.mech.plus {
+		data, ok := tlsExporter(exch.sess)
+		if !ok {
+			return nil, false, "", ErrAuthFailed
+		}
+
+		expectedBinding = append(expectedBinding, data...)
+	}
+
+	if 1 != subtle.ConstantTimeCompare(expectedBinding, binding) || parts[1][2:] != exch.nonce {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(message[proofStart+3:])
+	if nil != err || sha256.Size != len(proof) {
+		return nil, false, "", ErrAuthMalformed
+	}
+
+	authMessage := []byte(exch.clientFirstBare + "," + exch.serverFirst + "," + withoutProof)
+
+	clientSignature := hmacSHA256(exch.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+
+	if exch.unknown || 1 != subtle.ConstantTimeCompare(storedKey[:], exch.credentials.StoredKey) {
+		return nil, false, "", ErrAuthFailed
+	}
+
+	exch.serverSignature = hmacSHA256(exch.credentials.ServerKey, authMessage)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(exch.serverSignature)), false, "", nil
+}
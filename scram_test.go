@@ -0,0 +1,320 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+	tst "testing"
+)
+
+type testCredentialStore map[string]SCRAMCredentials
+
+func (store testCredentialStore) SCRAMSHA256(ctx context.Context, sess *Session, username string) (SCRAMCredentials, error) {
+	if "broken" == username {
+		return SCRAMCredentials{}, errors.New("broken")
+	}
+
+	credentials, ok := store[username]
+	if !ok {
+		return SCRAMCredentials{}, ErrAuthFailed
+	}
+
+	return credentials, nil
+}
+
+func testSCRAMStore() testCredentialStore {
+	return testCredentialStore{
+		"someone": NewSCRAMSHA256Credentials("secret", []byte("salt"), 4096),
+	}
+}
+
+// Runs the client side of a SCRAM-SHA-256 exchange and returns the last reply.
+func testSCRAMAuth(conn net.Conn, reader *bufio.Reader, mechanism, gs2Header string, cbData []byte, username, password string) string {
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+
+	conn.Write([]byte("AUTH " + mechanism + " " + testBase64(gs2Header+clientFirstBare) + "\r\n"))
+
+	line, _ := reader.ReadString('\n')
+	if !strings.HasPrefix(line, "334 ") {
+		return line
+	}
+
+	decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[4:]))
+	serverFirst := string(decoded)
+
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(serverFirst, ",") {
+		attributes[attribute[:1]] = attribute[2:]
+	}
+
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	iterations, _ := strconv.Atoi(attributes["i"])
+
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...)) + ",r=" + attributes["r"]
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	conn.Write([]byte(testBase64(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)) + "\r\n"))
+
+	line, _ = reader.ReadString('\n')
+	if !strings.HasPrefix(line, "334 ") {
+		return line
+	}
+
+	serverSignature := hmacSHA256(hmacSHA256(saltedPassword, []byte("Server Key")), authMessage)
+
+	if "334 "+testBase64("v="+base64.StdEncoding.EncodeToString(serverSignature))+"\r\n" != line {
+		return line
+	}
+
+	conn.Write([]byte("\r\n"))
+
+	line, _ = reader.ReadString('\n')
+
+	return line
+}
+
+func TestSCRAMSHA256(t *tst.T) {
+	examples := []struct {
+		GS2Header string
+		Username  string
+		Password  string
+		Expected  string
+		Identity  string
+	}{
+		{"n,,", "someone", "secret", "235 2.7.0 Authentication successful", "someone"},
+		{"n,a=someone,", "someone", "secret", "235 2.7.0 Authentication successful", "someone"},
+		{"y,,", "someone", "secret", "235 2.7.0 Authentication successful", "someone"},
+		{"n,,", "someone", "wrong", "535 5.7.8 Authentication credentials invalid", ""},
+		{"n,,", "other", "secret", "535 5.7.8 Authentication credentials invalid", ""},
+		{"n,a=other,", "someone", "secret", "535 5.7.8 Authentication credentials invalid", ""},
+		{"p=tls-exporter,,", "someone", "secret", "535 5.7.8 Authentication credentials invalid", ""},
+		{"n,,", "broken", "secret", "454 4.7.0 Temporary authentication failure", ""},
+		{"x,,", "someone", "secret", "501 5.5.2 Cannot decode response", ""},
+	}
+
+	for _, ex := range examples {
+		identity := ""
+
+		server := NewServer(Config{
+			Domain:            "example.com",
+			Logger:            zap.NewExample(),
+			AllowInsecureAuth: true,
+			Mechanisms: []Mechanism{
+				NewSCRAMSHA256Mechanism(testSCRAMStore(), true),
+				NewSCRAMSHA256Mechanism(testSCRAMStore(), false),
+			},
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				identity = sess.Identity()
+
+				return &testEnvelope{}, nil
+			},
+		})
+
+		conn, reader, _ := testServerDial(t, server)
+
+		testServerDialog(t, conn, reader, []string{
+			"", "220 example.com Service ready",
+			"EHLO domain.com", "250-example.com greetings",
+			"", "250-8BITMIME",
+			"", "250-SIZE",
+			"", "250-PIPELINING",
+			"", "250-CHUNKING",
+			"", "250-BINARYMIME",
+			"", "250-SMTPUTF8",
+			"", "250-DSN",
+			"", "250-ENHANCEDSTATUSCODES",
+			"", "250 AUTH SCRAM-SHA-256",
+		})
+
+		line := testSCRAMAuth(conn, reader, "SCRAM-SHA-256", ex.GS2Header, nil, ex.Username, ex.Password)
+		if ex.Expected+"\r\n" != line {
+			t.Errorf("Unexpected reply for %q %q: %q", ex.GS2Header, ex.Username, line)
+		}
+
+		testServerDialog(t, conn, reader, []string{
+			"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		})
+
+		if ex.Identity != identity {
+			t.Errorf("Unexpected identity for %q %q: %q", ex.GS2Header, ex.Username, identity)
+		}
+
+		conn.Close()
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestSCRAMSHA256Plus(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		TLS:    testTLSConfig(t),
+		Mechanisms: []Mechanism{
+			NewSCRAMSHA256Mechanism(testSCRAMStore(), true),
+			NewSCRAMSHA256Mechanism(testSCRAMStore(), false),
+		},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	go server.ServeTLS(context.Background(), listener)
+	defer server.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if nil != err {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"EHLO domain.com", "250-example.com greetings",
+		"", "250-8BITMIME",
+		"", "250-SIZE",
+		"", "250-PIPELINING",
+		"", "250-CHUNKING",
+		"", "250-BINARYMIME",
+		"", "250-SMTPUTF8",
+		"", "250-DSN",
+		"", "250-ENHANCEDSTATUSCODES",
+		"", "250 AUTH SCRAM-SHA-256-PLUS SCRAM-SHA-256",
+	})
+
+	state := conn.ConnectionState()
+
+	cbData, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, 32)
+	if nil != err {
+		t.Fatalf("Exporting keying material failed: %v", err)
+	}
+
+	examples := []struct {
+		Mechanism string
+		GS2Header string
+		CBData    []byte
+		Expected  string
+	}{
+		{"SCRAM-SHA-256", "y,,", nil, "535 5.7.8 Authentication credentials invalid"},
+		{"SCRAM-SHA-256-PLUS", "n,,", nil, "535 5.7.8 Authentication credentials invalid"},
+		{"SCRAM-SHA-256-PLUS", "p=tls-exporter,,", []byte("wrong"), "535 5.7.8 Authentication credentials invalid"},
+		{"SCRAM-SHA-256-PLUS", "p=tls-exporter,,", cbData, "235 2.7.0 Authentication successful"},
+	}
+
+	for _, ex := range examples {
+		line := testSCRAMAuth(conn, reader, ex.Mechanism, ex.GS2Header, ex.CBData, "someone", "secret")
+		if ex.Expected+"\r\n" != line {
+			t.Errorf("Unexpected reply for %v %q: %q", ex.Mechanism, ex.GS2Header, line)
+		}
+	}
+}
+
+func TestSCRAMSHA256UnknownUser(t *tst.T) {
+	mech := NewSCRAMSHA256Mechanism(testSCRAMStore(), false)
+
+	serverFirst := func(username string) string {
+		exch := mech.Start(context.Background(), nil)
+		exch.Next(context.Background(), nil)
+
+		challenge, done, _, err := exch.Next(context.Background(), []byte("n,,n="+username+",r=clientnonce"))
+		if nil != err || done {
+			t.Fatalf("Unexpected server-first-message for %q: %v %v", username, done, err)
+		}
+
+		attributes := strings.Split(string(challenge), ",")
+		if 3 != len(attributes) || "i=4096" != attributes[2] {
+			t.Fatalf("Unexpected server-first-message for %q: %q", username, challenge)
+		}
+
+		nonce := attributes[0][2:]
+
+		_, _, _, err = exch.Next(context.Background(), []byte("c=biws,r="+nonce+",p="+base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))))
+		if ErrAuthFailed != err {
+			t.Errorf("Unexpected error for the proof of %q: %v", username, err)
+		}
+
+		return attributes[1]
+	}
+
+	salt := serverFirst("other")
+
+	if salt != serverFirst("other") {
+		t.Errorf("Unexpected different salts for the same unknown user")
+	}
+
+	if salt == serverFirst("another") {
+		t.Errorf("Unexpected same salt for different unknown users")
+	}
+}
+
+func TestSCRAMSHA256Vector(t *tst.T) {
+	// example exchange from RFC 7677 section 3
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+
+	exch := &scramExchange{
+		mech:            &scramMechanism{},
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		username:        "user",
+		credentials:     NewSCRAMSHA256Credentials("pencil", salt, 4096),
+	}
+
+	challenge, done, _, err := exch.Next(context.Background(), []byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	if nil != err || done || "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" != string(challenge) {
+		t.Fatalf("Unexpected server-final-message: %q %v %v", challenge, done, err)
+	}
+
+	_, done, identity, err := exch.Next(context.Background(), []byte{})
+	if nil != err || !done || "user" != identity {
+		t.Errorf("Unexpected outcome: %v %q %v", done, identity, err)
+	}
+}
+
+func TestDecodeSaslname(t *tst.T) {
+	examples := map[string]struct {
+		Expected string
+		OK       bool
+	}{
+		"someone":   {"someone", true},
+		"a=2Cb=3Dc": {"a,b=c", true},
+		"=3D=3D":    {"==", true},
+		"a=2":       {"", false},
+		"a=41":      {"", false},
+		"trailing=": {"", false},
+		"":          {"", true},
+	}
+
+	for input, ex := range examples {
+		name, ok := decodeSaslname(input)
+
+		if ex.OK != ok || ex.Expected != name {
+			t.Errorf("Unexpected result for %q: %q %v", input, name, ok)
+		}
+	}
+}
@@ -3,12 +3,25 @@ package smtp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"go.uber.org/zap"
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
+// Returned by Serve and ListenAndServe once the server has stopped accepting
+// connections because the context was cancelled or Shutdown was called.
+var ErrServerClosed = errors.New("smtp: server closed")
+
+// Returned by AcceptTLS, ServeTLS and ListenAndServeTLS if the server has no
+// TLS config.
+var ErrServeTLSWithoutConfig = errors.New("smtp: implicit TLS requires a TLS config")
+
+// Deadline used to interrupt blocking reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // A SMTP server configuration.
 type Config struct {
 	// SMTP service's domain. This should be the same domain advertised in the
@@ -22,12 +35,66 @@ type Config struct {
 	// unspecified will use 4 pages.
 	BufferSize uint
 
-	// TLS config for the server.
+	// TLS config for the server, used for STARTTLS as well as for implicit TLS
+	// connections accepted with AcceptTLS or ServeTLS.
 	TLS *tls.Config
 
 	// Whether this SMTP server requires STARTTLS. Does not make sense if TLS is nil.
 	TLSRequired bool
 
+	// Callback verifying the credentials of the AUTH PLAIN and LOGIN
+	// mechanisms, which are only offered if this is set. The identity is the
+	// authorization identity requested by the client, empty if it wishes to
+	// act as the username. Returning an error fails the authentication
+	// temporarily.
+	Authenticator func(ctx context.Context, sess *Session, identity, username, password string) (bool, error)
+
+	// Additional SASL mechanisms offered by AUTH, after PLAIN and LOGIN if
+	// the Authenticator is set.
+	Mechanisms []Mechanism
+
+	// Whether AUTH is offered over connections without TLS, which exposes
+	// the credentials of the client.
+	AllowInsecureAuth bool
+
+	// Maximum size of a message in octets, advertised with SIZE. MAIL commands
+	// declaring a larger SIZE are rejected, as is any content exceeding it.
+	// If unspecified messages are not limited.
+	MaxMessageSize uint64
+
+	// Whether lines longer than allowed by RFC 5321, 512 octets for commands
+	// and 1000 for the content of messages, are tolerated. Commands are then
+	// accepted if they fit the buffer, and content lines are written to the
+	// envelope in pieces if they do not. Otherwise a long command is rejected
+	// with a 500 reply, and a message with a long line with a 554 reply at
+	// its end.
+	TolerateLongLines bool
+
+	// Handling of a bare CR or LF in commands and in content sent with DATA.
+	// If unspecified they are rejected.
+	BareLineEndings BareLineEndings
+
+	// Whether a Received header is prepended to the content of messages, as
+	// required of SMTP servers by RFC 5321 section 4.4.
+	ReceivedHeader bool
+
+	// Whether a Return-Path header with the reverse-path is prepended to the
+	// content of messages, which is usually only done on final delivery.
+	ReturnPathHeader bool
+
+	// Maximum number of Received headers in the header section of messages,
+	// beyond which they are rejected with a 554 reply as looping, RFC 5321
+	// section 6.3. If unspecified 100 are allowed, while a negative value
+	// disables the check.
+	MaxReceivedHeaders int
+
+	// Timeouts for each phase of the dialog. Zero values use the defaults
+	// from RFC 5321.
+	Timeouts Timeouts
+
+	// Additional service extensions, advertised after the built-in ones.
+	Extensions []Extension
+
 	// Callback for creating a new envelope.
 	NewEnvelope func(ctx context.Context, sess *Session) (Envelope, error)
 
@@ -39,10 +106,21 @@ type Config struct {
 type Server struct {
 	Config *Config
 
+	// cancelled once Shutdown forcefully closes the remaining connections
 	context    context.Context
+	cancel     context.CancelFunc
 	bufferPool *sync.Pool
 
 	wait *sync.WaitGroup
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	mechanisms []Mechanism
 }
 
 // Creates a new Server with the provided Config.
@@ -71,24 +149,62 @@ func NewServer(config Config) *Server {
 		config.BufferSize = uint(4 * os.Getpagesize())
 	}
 
+	config.Timeouts = config.Timeouts.withDefaults()
+
+	if 0 == config.MaxReceivedHeaders {
+		config.MaxReceivedHeaders = 100
+	}
+
 	if config.BufferSize < 538 {
 		config.Logger.Warn("server configured with BufferSize less than 538, which is not recommended", zap.Uint("BufferSize", config.BufferSize))
 	}
 
+	var mechanisms []Mechanism = nil
+
+	if nil != config.Authenticator {
+		mechanisms = append(mechanisms, NewPlainMechanism(config.Authenticator), NewLoginMechanism(config.Authenticator))
+	}
+
+	mechanisms = append(mechanisms, config.Mechanisms...)
+
+	serverCtx, cancel := context.WithCancel(context.Background())
+
 	return &Server{
 		Config:  &config,
-		context: context.Background(),
+		context: serverCtx,
+		cancel:  cancel,
 		bufferPool: &sync.Pool{
 			New: func() interface{} {
 				return make([]byte, config.BufferSize)
 			},
 		},
-		wait: &sync.WaitGroup{},
+		wait:      &sync.WaitGroup{},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		closing:   make(chan struct{}),
+
+		mechanisms: mechanisms,
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	select {
+	case <-srv.closing:
+		return true
+
+	default:
+		return false
 	}
 }
 
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+
+	return ok && netErr.Timeout()
+}
+
 func (srv *Server) dialog(ctx context.Context, session *Session, conn net.Conn, logger *zap.Logger) {
-	var reply []byte = nil
+	var reply Reply
 	var err error = nil
 	var action sessionAction = keepSession
 	var running bool = true
@@ -96,60 +212,189 @@ func (srv *Server) dialog(ctx context.Context, session *Session, conn net.Conn,
 	var buffer []byte = srv.bufferPool.Get().([]byte)
 	var fill []byte = buffer
 	var readConn net.Conn = conn
+	var replies []byte = make([]byte, 0, 512)
 
+	// cancelled when the dialog is killed, so that a StreamEnvelope which
+	// stopped reading the content does not block it
 	readCtx, cancel := context.WithCancel(srv.context)
 
 	kill := func() {
 		logger.Debug("killing")
 
-		reply, err = session.kill(readCtx)
+		cancel()
+
+		reply, err = session.kill(srv.context)
 		if nil != err {
 			logger.Warn("kill failed", zap.Error(err))
 		}
 
-		if nil != reply {
-			readConn.Write(reply)
+		if 0 != reply.Code {
+			readConn.SetWriteDeadline(deadline(srv.Config.Timeouts.Command))
+			readConn.Write(reply.Bytes())
 		}
 
 		running = false
 	}
 
+	flush := func() bool {
+		if 0 == len(replies) {
+			return true
+		}
+
+		readConn.SetWriteDeadline(deadline(srv.Config.Timeouts.Command))
+		_, err = readConn.Write(replies)
+		replies = replies[:0]
+
+		if nil != err {
+			logger.Debug("write failed", zap.Error(err))
+			return false
+		}
+
+		return true
+	}
+
 	read := func() {
+		phase := session.phase()
+
+		// the deadline must be set before checking for cancellation, so
+		// that it does not override the one used to interrupt the read
+		phaseDeadline := deadline(srv.Config.Timeouts.forPhase(phase))
+		readConn.SetReadDeadline(phaseDeadline)
+
+		if nil != ctx.Err() {
+			logger.Debug("context cancelled")
+
+			kill()
+			return
+		}
+
+		if srv.shuttingDown() && !session.state.inDATA() && !session.state.inBDAT() && !session.chunkPending() {
+			logger.Debug("shutting down")
+
+			kill()
+			return
+		}
+
 		n, err = readConn.Read(fill)
 
 		if 0 == n && nil != err {
+			if isTimeout(err) {
+				if phaseDeadline.IsZero() || time.Now().Before(phaseDeadline) {
+					// interrupted before the phase timed out, the next read
+					// will decide what to do, while a timeout of the phase
+					// kills the session also when shutting down
+					logger.Debug("read interrupted", zap.Error(err))
+
+					return
+				}
+
+				logger.Info("timeout", zap.String("phase", phaseNames[phase]), zap.Error(err))
+
+				kill()
+				return
+			}
+
 			logger.Debug("end-of-stream", zap.Error(err))
 
 			running = false
 		} else {
 			shouldKill := false
 
-			remaining := readLines(buffer[:len(buffer)-len(fill)+n], func(line []byte) lineControl {
-				reply, action, err = session.advance(readCtx, line)
+			handle := func() lineControl {
 				if nil != err {
 					logger.Warn("advance failed", zap.Error(err))
 				}
 
-				if nil != reply {
-					_, err = readConn.Write(reply)
+				if 0 != reply.Code {
+					replies = append(replies, reply.Bytes()...)
+				}
 
-					if nil != err {
-						shouldKill = true
-						return discardLines
-					}
+				if 421 == reply.Code {
+					// also when returned by the envelope, the channel is
+					// closed after a 421 reply, RFC 5321 section 3.8
+					action = closeSession
 				}
 
 				switch action {
 				case closeSession, upgradeSession:
 					return discardLines
+
+				case flushSession:
+					if !flush() {
+						shouldKill = true
+						return discardLines
+					}
+				}
+
+				if session.chunkPending() {
+					return pauseLines
 				}
 
 				return readMoreLines
-			})
+			}
 
-			if nil != remaining {
+			remaining := buffer[:len(buffer)-len(fill)+n]
+
+			for nil != remaining {
+				if !session.chunkPending() {
+					remaining = readLines(remaining, NormalizeBareLineEndings == session.config.bareLineEndings, func(line []byte) lineControl {
+						reply, action, err = session.advance(readCtx, line)
+
+						return handle()
+					})
+
+					if !session.chunkPending() {
+						if len(remaining) == len(buffer) {
+							// this buffer does not contain a line, pass it on
+							// as a piece of a long one
+							piece := remaining
+							if '\r' == piece[len(piece)-1] {
+								// may be the start of the CRLF in the next read
+								piece = piece[:len(piece)-1]
+							}
+
+							if 0 != len(piece) {
+								reply, action, err = session.advancePiece(readCtx, piece)
+								remaining = remaining[len(piece):]
+
+								if discardLines == handle() {
+									remaining = nil
+								}
+							}
+						}
+
+						break
+					}
+				}
+
+				if 0 == len(remaining) {
+					// the rest of the chunk is in the next read
+					remaining = nil
+					break
+				}
+
+				// BDAT chunks are read as exact octets, not lines
+				size := len(remaining)
+				if session.state.chunkSize < uint64(size) {
+					size = int(session.state.chunkSize)
+				}
+
+				reply, action, err = session.advanceChunk(readCtx, remaining[:size])
+				remaining = remaining[size:]
+
+				if discardLines == handle() {
+					remaining = nil
+				}
+			}
+
+			// the input buffer is drained, send the replies of the pipelined
+			// group before blocking on the next read
+			if shouldKill || !flush() {
+				kill()
+				running = false
+			} else if nil != remaining {
 				if len(remaining) == len(buffer) {
-					// this buffer does not contain a line, kill the connection
+					// this buffer cannot hold a piece of a line, kill the connection
 					logger.Warn("buffer did not contain a line, check the BufferSize config", zap.Int("BufferSize", len(buffer)))
 					kill()
 				} else {
@@ -159,63 +404,95 @@ func (srv *Server) dialog(ctx context.Context, session *Session, conn net.Conn,
 			} else {
 				fill = buffer
 
-				if shouldKill {
-					kill()
-					running = false
-				} else {
-					switch action {
-					case upgradeSession:
-						logger.Debug("upgrade action")
-
-						tlsConn := tls.Server(readConn, srv.Config.TLS)
-						readConn = tlsConn
+				switch action {
+				case upgradeSession:
+					logger.Debug("upgrade action")
 
-						err = tlsConn.Handshake()
-						if nil != err {
-							logger.Warn("tls handshake failed", zap.Error(err))
+					tlsConn := tls.Server(readConn, srv.Config.TLS)
+					readConn = tlsConn
 
-							running = false
-						}
+					readConn.SetDeadline(deadline(srv.Config.Timeouts.Command))
+					err = tlsConn.Handshake()
+					if nil != err {
+						logger.Warn("tls handshake failed", zap.Error(err))
 
-					case closeSession:
-						logger.Debug("close action")
 						running = false
+					} else {
+						state := tlsConn.ConnectionState()
+						session.state.tlsState = &state
 					}
+
+				case closeSession:
+					logger.Debug("close action")
+					running = false
 				}
 			}
 		}
 	}
 
-	done := ctx.Done()
+	finished := make(chan struct{})
 
-	logger.Debug("greeting")
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the dialog is killed, also if it is blocked on streaming
+			cancel()
 
-	_, err = readConn.Write(session.greet(readCtx))
+		case <-srv.closing:
+		case <-finished:
+			return
+		}
 
-	if nil != err {
-		logger.Warn("greeting failed", zap.Error(err))
-	} else {
-		if nil == done {
-			logger.Debug("context does not support cancellation")
+		// interrupt any blocking read so that the dialog loop can notice
+		conn.SetReadDeadline(aLongTimeAgo)
+	}()
 
-			for running {
-				read()
-			}
+	readConn.SetDeadline(deadline(srv.Config.Timeouts.Greeting))
+
+	if session.state.tls {
+		// implicit TLS, the handshake precedes the greeting
+		logger.Debug("implicit tls handshake")
+
+		tlsConn := tls.Server(readConn, srv.Config.TLS)
+		readConn = tlsConn
+
+		err = tlsConn.Handshake()
+		if nil != err {
+			logger.Warn("tls handshake failed", zap.Error(err))
 		} else {
-			for running {
-				select {
-				case <-done:
-					logger.Debug("context cancelled")
+			state := tlsConn.ConnectionState()
+			session.state.tlsState = &state
+		}
+	}
 
-					kill()
+	if nil == err {
+		if srv.shuttingDown() {
+			logger.Debug("shutting down before greeting")
 
-				default:
-					read()
-				}
+			kill()
+		} else {
+			logger.Debug("greeting")
+
+			_, err = readConn.Write(session.greet(readCtx).Bytes())
+			if nil != err {
+				logger.Warn("greeting failed", zap.Error(err))
 			}
 		}
 	}
 
+	if nil == err {
+		for running {
+			read()
+		}
+	}
+
+	close(finished)
+
+	err = session.state.Discard(readCtx)
+	if nil != err {
+		logger.Warn("discarding state at end of dialog failed", zap.Error(err))
+	}
+
 	srv.bufferPool.Put(buffer)
 	buffer = nil
 
@@ -229,7 +506,7 @@ func (srv *Server) dialog(ctx context.Context, session *Session, conn net.Conn,
 	}
 }
 
-func (srv *Server) handle(ctx context.Context, conn net.Conn, sessionFn func(ctx context.Context, srv *Server, sess *Session, init bool)) {
+func (srv *Server) handle(ctx context.Context, conn net.Conn, implicitTLS bool, sessionFn func(ctx context.Context, srv *Server, sess *Session, init bool)) {
 	id := generateID()
 	addr := conn.RemoteAddr().String()
 
@@ -245,11 +522,35 @@ func (srv *Server) handle(ctx context.Context, conn net.Conn, sessionFn func(ctx
 			domain:      srv.Config.Domain,
 			tls:         nil != srv.Config.TLS,
 			tlsRequired: srv.Config.TLSRequired,
+
+			mechanisms:   srv.mechanisms,
+			insecureAuth: srv.Config.AllowInsecureAuth,
+
+			receivedHeader:   srv.Config.ReceivedHeader,
+			returnPathHeader: srv.Config.ReturnPathHeader,
+
+			maxReceivedHeaders: srv.Config.MaxReceivedHeaders,
+
+			maxMessageSize:    srv.Config.MaxMessageSize,
+			tolerateLongLines: srv.Config.TolerateLongLines,
+			bareLineEndings:   srv.Config.BareLineEndings,
+
+			commitTimeout: srv.Config.Timeouts.DATATermination,
+
+			extensions: append(builtinExtensions(), srv.Config.Extensions...),
+
 			newEnvelope: srv.Config.NewEnvelope,
 			logger:      logger,
 		},
+		state: sessionState{
+			tls: implicitTLS,
+		},
 	}
 
+	srv.mutex.Lock()
+	srv.conns[conn] = struct{}{}
+	srv.mutex.Unlock()
+
 	if nil != sessionFn {
 		sessionFn(ctx, srv, session, true)
 	}
@@ -260,6 +561,10 @@ func (srv *Server) handle(ctx context.Context, conn net.Conn, sessionFn func(ctx
 		sessionFn(ctx, srv, session, false)
 	}
 
+	srv.mutex.Lock()
+	delete(srv.conns, conn)
+	srv.mutex.Unlock()
+
 	srv.wait.Done()
 }
 
@@ -269,11 +574,238 @@ func (srv *Server) handle(ctx context.Context, conn net.Conn, sessionFn func(ctx
 // started with this to finish. Cancelling the context will close all dialogs
 // in an orderly fashion.
 func (srv *Server) Accept(ctx context.Context, conn net.Conn, sessionFn func(ctx context.Context, srv *Server, sess *Session, init bool)) {
+	srv.start(ctx, conn, false, sessionFn)
+}
+
+// Accept a new SMTP connection with implicit TLS (RFC 8314), otherwise the
+// same as Accept. The TLS handshake is performed before the greeting and
+// STARTTLS is neither advertised nor accepted. If the server has no TLS config
+// the connection is closed and ErrServeTLSWithoutConfig returned.
+func (srv *Server) AcceptTLS(ctx context.Context, conn net.Conn, sessionFn func(ctx context.Context, srv *Server, sess *Session, init bool)) error {
+	if nil == srv.Config.TLS {
+		conn.Close()
+
+		return ErrServeTLSWithoutConfig
+	}
+
+	srv.start(ctx, conn, true, sessionFn)
+
+	return nil
+}
+
+// Starts the dialog of a connection, unless the server is shutting down. The
+// dialog is added under the mutex after checking for that, so that Shutdown
+// either refuses it or waits for it.
+func (srv *Server) start(ctx context.Context, conn net.Conn, implicitTLS bool, sessionFn func(ctx context.Context, srv *Server, sess *Session, init bool)) {
+	srv.mutex.Lock()
+	if srv.shuttingDown() {
+		srv.mutex.Unlock()
+
+		go srv.refuse(conn, implicitTLS)
+
+		return
+	}
 	srv.wait.Add(1)
-	go srv.handle(ctx, conn, sessionFn)
+	srv.mutex.Unlock()
+
+	go srv.handle(ctx, conn, implicitTLS, sessionFn)
+}
+
+// Sends a 421 reply to a connection accepted while shutting down and closes
+// it, without a dialog for Shutdown to wait for.
+func (srv *Server) refuse(conn net.Conn, implicitTLS bool) {
+	conn.SetDeadline(deadline(srv.Config.Timeouts.Greeting))
+
+	if implicitTLS {
+		// the handshake precedes the reply
+		conn = tls.Server(conn, srv.Config.TLS)
+	}
+
+	conn.Write(replyServiceNotAvailable(srv.Config.Domain).Bytes())
+	conn.Close()
 }
 
 // Waits for all goroutines started from within Accept to finish orderly.
 func (srv *Server) Wait() {
 	srv.wait.Wait()
 }
+
+// Gracefully shut down the server. All listeners passed to Serve are closed,
+// sessions that are not transferring data are sent a 421 reply and closed,
+// while sessions in the middle of DATA are allowed to commit their
+// transaction first. If the context expires before all dialogs have finished,
+// the remaining connections are forcefully closed, the contexts passed to
+// envelopes cancelled, and the context's error is returned. Connections
+// accepted after Shutdown are immediately sent a 421 reply.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	// closed under the mutex, so that no dialog is started once waiting
+	srv.mutex.Lock()
+	srv.closingOnce.Do(func() {
+		close(srv.closing)
+	})
+
+	for listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.mutex.Unlock()
+
+	finished := make(chan struct{})
+
+	go func() {
+		srv.wait.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+
+	case <-ctx.Done():
+		srv.Config.Logger.Warn("shutdown deadline exceeded, closing remaining connections", zap.Error(ctx.Err()))
+
+		srv.mutex.Lock()
+		for conn := range srv.conns {
+			conn.Close()
+		}
+		srv.mutex.Unlock()
+
+		// also stops the dialogs blocked on a StreamEnvelope
+		srv.cancel()
+
+		return ctx.Err()
+	}
+}
+
+// Accept connections from the listener and start a dialog for each of them,
+// in the same way as Accept does. Temporary accept errors are retried with an
+// increasing delay. Cancelling the context or calling Shutdown closes the
+// listener, in which case ErrServerClosed is returned; any other accept error
+// is returned as-is. The listener is always closed when Serve returns.
+func (srv *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return srv.serve(ctx, listener, false)
+}
+
+// Same as Serve, but connections are accepted with AcceptTLS for implicit TLS
+// (SMTPS). Returns ErrServeTLSWithoutConfig if the server has no TLS config.
+func (srv *Server) ServeTLS(ctx context.Context, listener net.Listener) error {
+	if nil == srv.Config.TLS {
+		listener.Close()
+
+		return ErrServeTLSWithoutConfig
+	}
+
+	return srv.serve(ctx, listener, true)
+}
+
+func (srv *Server) serve(ctx context.Context, listener net.Listener, implicitTLS bool) error {
+	logger := srv.Config.Logger.With(zap.String("listener", listener.Addr().String()))
+
+	srv.mutex.Lock()
+	if srv.shuttingDown() {
+		srv.mutex.Unlock()
+		listener.Close()
+
+		return ErrServerClosed
+	}
+	srv.listeners[listener] = struct{}{}
+	srv.mutex.Unlock()
+
+	defer func() {
+		srv.mutex.Lock()
+		delete(srv.listeners, listener)
+		srv.mutex.Unlock()
+	}()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Debug("context cancelled, closing listener")
+
+			listener.Close()
+
+		case <-stopped:
+		}
+	}()
+
+	defer listener.Close()
+
+	var delay time.Duration = 0
+
+	for {
+		conn, err := listener.Accept()
+
+		if nil != err {
+			if nil != ctx.Err() || srv.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				if 0 == delay {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+
+				if delay > time.Second {
+					delay = time.Second
+				}
+
+				logger.Warn("temporary accept error, retrying", zap.Error(err), zap.Duration("delay", delay))
+
+				select {
+				case <-ctx.Done():
+					return ErrServerClosed
+
+				case <-time.After(delay):
+				}
+
+				continue
+			}
+
+			logger.Error("accept failed", zap.Error(err))
+
+			return err
+		}
+
+		delay = 0
+
+		srv.start(ctx, conn, implicitTLS, nil)
+	}
+}
+
+// Listen on the TCP network address and then call Serve. If addr is empty,
+// ":smtp" is used.
+func (srv *Server) ListenAndServe(ctx context.Context, addr string) error {
+	if "" == addr {
+		addr = ":smtp"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if nil != err {
+		return err
+	}
+
+	return srv.Serve(ctx, listener)
+}
+
+// Listen on the TCP network address and then call ServeTLS. If addr is empty,
+// ":465" is used.
+func (srv *Server) ListenAndServeTLS(ctx context.Context, addr string) error {
+	if nil == srv.Config.TLS {
+		return ErrServeTLSWithoutConfig
+	}
+
+	if "" == addr {
+		addr = ":465"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if nil != err {
+		return err
+	}
+
+	return srv.ServeTLS(ctx, listener)
+}
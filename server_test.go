@@ -1,11 +1,18 @@
 package smtp
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"go.uber.org/zap"
+	"io"
+	"net"
+	"reflect"
 	"strings"
 	tst "testing"
+	"time"
 )
 
 func TestServer(t *tst.T) {
@@ -87,39 +94,51 @@ func TestServer(t *tst.T) {
 
 	expected := strings.Join([]string{
 		"220 example.com Service ready",
-		"500 Syntax error, command unrecognized",
-		"500 Syntax error, command unrecognized",
-		"500 Syntax error, command unrecognized",
-		"500 Syntax error, command unrecognized",
+		"500 5.5.2 Syntax error, command unrecognized",
+		"500 5.5.2 Syntax error, command unrecognized",
+		"500 5.5.2 Syntax error, command unrecognized",
+		"500 5.5.2 Syntax error, command unrecognized",
 		"250-example.com greetings",
 		"250-8BITMIME",
-		"250 SIZE",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
 		"250 example.com greetings",
 		"250-example.com greetings",
 		"250-8BITMIME",
-		"250 SIZE",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"354 Start mail input; end with <CRLF>.<CRLF>",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"354 Start mail input; end with <CRLF>.<CRLF>",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"503 Bad sequence of commands",
-		"250 Requested mail action okay, completed",
-		"250 Requested mail action okay, completed",
-		"502 Command not implemented",
-		"502 Command not implemented",
-		"250 Requested mail action okay, completed",
-		"502 Command not implemented",
-		"502 Command not implemented",
-		"221 example.com Service closing transmission channel",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"503 5.5.1 Bad sequence of commands",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"502 5.5.1 Command not implemented",
+		"502 5.5.1 Command not implemented",
+		"250 2.0.0 Requested mail action okay, completed",
+		"502 5.5.1 Command not implemented",
+		"502 5.5.1 Command not implemented",
+		"221 2.0.0 example.com Service closing transmission channel",
 		"",
 	}, "\r\n")
 
@@ -129,3 +148,2021 @@ func TestServer(t *tst.T) {
 		t.Errorf("Unexpected output: %v", result)
 	}
 }
+
+func TestServerNullReversePath(t *tst.T) {
+	froms := make([][]byte, 0, 2)
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{
+				onFrom: func(ctx context.Context, env *testEnvelope, addr []byte) (FromAction, error) {
+					froms = append(froms, addr)
+
+					return AcceptFROM, nil
+				},
+			}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<>",
+		"RCPT TO:<someone@example.com>",
+		"RCPT TO:<>",
+		"RSET",
+		"MAIL FROM:<someone@domain.com>",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"501 5.1.3 Bad destination mailbox address syntax",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 2 != len(froms) {
+		t.Fatalf("Unexpected number of reverse-paths: %v", len(froms))
+	}
+
+	if nil == froms[0] || 0 != len(froms[0]) {
+		t.Errorf("Unexpected null reverse-path: %q", froms[0])
+	}
+
+	if "someone@domain.com" != string(froms[1]) {
+		t.Errorf("Unexpected reverse-path: %q", froms[1])
+	}
+}
+
+func TestServerServe(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if "220 example.com Service ready\r\n" != line {
+		t.Errorf("Unexpected greeting: %q %v", line, err)
+	}
+
+	conn.Write([]byte("QUIT\r\n"))
+
+	line, err = reader.ReadString('\n')
+	if "221 2.0.0 example.com Service closing transmission channel\r\n" != line {
+		t.Errorf("Unexpected reply: %q %v", line, err)
+	}
+
+	conn.Close()
+
+	cancel()
+
+	err = <-served
+	if ErrServerClosed != err {
+		t.Errorf("Unexpected Serve result: %v", err)
+	}
+
+	server.Wait()
+
+	_, err = net.Dial("tcp", listener.Addr().String())
+	if nil == err {
+		t.Errorf("Listener was not closed")
+	}
+}
+
+func TestServerServeAcceptErrors(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	permanent := &testNetError{temporary: false}
+
+	listener := &testListener{
+		addr: &testAddr{
+			network: "tcp",
+			address: "127.0.0.1:25",
+		},
+		onAccept: func(listener *testListener) (net.Conn, error) {
+			if listener.acceptCalls < 3 {
+				return nil, &testNetError{temporary: true}
+			}
+
+			return nil, permanent
+		},
+	}
+
+	err := server.Serve(context.Background(), listener)
+
+	if permanent != err {
+		t.Errorf("Unexpected Serve result: %v", err)
+	}
+
+	if 3 != listener.acceptCalls {
+		t.Errorf("Unexpected number of accept calls: %v", listener.acceptCalls)
+	}
+}
+
+func testServerDial(t *tst.T, server *Server) (net.Conn, *bufio.Reader, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve(context.Background(), listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	return conn, bufio.NewReader(conn), served
+}
+
+func testServerDialog(t *tst.T, conn net.Conn, reader *bufio.Reader, dialog []string) {
+	for i := 0; i < len(dialog); i += 2 {
+		if "" != dialog[i] {
+			conn.Write([]byte(dialog[i] + "\r\n"))
+		}
+
+		line, err := reader.ReadString('\n')
+		if dialog[i+1]+"\r\n" != line {
+			t.Errorf("Unexpected reply to %q: %q %v", dialog[i], line, err)
+		}
+	}
+}
+
+func TestServerShutdownIdle(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	conn, reader, served := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+	})
+
+	err := server.Shutdown(context.Background())
+	if nil != err {
+		t.Errorf("Unexpected Shutdown result: %v", err)
+	}
+
+	testServerDialog(t, conn, reader, []string{
+		"", "421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+
+	err = <-served
+	if ErrServerClosed != err {
+		t.Errorf("Unexpected Serve result: %v", err)
+	}
+}
+
+func TestServerAcceptAfterShutdown(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	if err := server.Shutdown(context.Background()); nil != err {
+		t.Errorf("Unexpected Shutdown result: %v", err)
+	}
+
+	closed := make(chan struct{})
+
+	conn := testServerConn("HELO domain.com")
+	conn.onClose = func(conn *testConn) error {
+		close(closed)
+
+		return nil
+	}
+
+	server.Accept(context.Background(), conn, func(ctx context.Context, srv *Server, sess *Session, init bool) {
+		t.Errorf("Unexpected dialog after Shutdown")
+	})
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Connection was not closed")
+	}
+
+	if "421 4.3.2 example.com Service not available, closing transmission channel\r\n" != conn.writer.String() || 0 != conn.readCalls {
+		t.Errorf("Unexpected output: %q", conn.writer.String())
+	}
+}
+
+func TestServerShutdownInDATA(t *tst.T) {
+	envelope := &testEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	conn, reader, served := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+		"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+	})
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	err := <-served
+	if ErrServerClosed != err {
+		t.Errorf("Unexpected Serve result: %v", err)
+	}
+
+	testServerDialog(t, conn, reader, []string{
+		"hello\r\n.", "250 2.0.0 Requested mail action okay, completed",
+		"", "421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+
+	err = <-shutdown
+	if nil != err {
+		t.Errorf("Unexpected Shutdown result: %v", err)
+	}
+
+	if 1 != envelope.commitCalls || "hello\r\n" != envelope.data.String() {
+		t.Errorf("Transaction was not committed: %v %q", envelope.commitCalls, envelope.data.String())
+	}
+}
+
+func TestServerShutdownTimeoutInDATA(t *tst.T) {
+	envelope := &testEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		Timeouts: Timeouts{
+			DATABlock: 100 * time.Millisecond,
+		},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	conn, reader, _ := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+		"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+	})
+
+	conn.Write([]byte("hello\r\n"))
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	// the client goes quiet in the middle of DATA
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	testServerDialog(t, conn, reader, []string{
+		"", "421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+
+	select {
+	case err := <-shutdown:
+		if nil != err {
+			t.Errorf("Unexpected Shutdown result: %v", err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown did not return after the DATA timeout")
+	}
+
+	if 0 != envelope.commitCalls || 1 != envelope.discardCalls {
+		t.Errorf("Transaction was not discarded: %v %v", envelope.commitCalls, envelope.discardCalls)
+	}
+}
+
+func TestServerShutdownInDATARepeated(t *tst.T) {
+	// the interruption of reads by Shutdown must never be taken for a timeout
+	for i := 0; i < 50; i++ {
+		envelope := &testEnvelope{}
+
+		server := NewServer(Config{
+			Domain: "example.com",
+			Logger: zap.NewExample(),
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				return envelope, nil
+			},
+		})
+
+		conn, reader, _ := testServerDial(t, server)
+
+		testServerDialog(t, conn, reader, []string{
+			"", "220 example.com Service ready",
+			"HELO domain.com", "250 example.com greetings",
+			"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+			"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+			"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+		})
+
+		shutdown := make(chan error, 1)
+
+		go func() {
+			shutdown <- server.Shutdown(context.Background())
+		}()
+
+		for j := 0; j < 10; j++ {
+			conn.Write([]byte("hello\r\n"))
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		testServerDialog(t, conn, reader, []string{
+			".", "250 2.0.0 Requested mail action okay, completed",
+			"", "421 4.3.2 example.com Service not available, closing transmission channel",
+		})
+
+		if err := <-shutdown; nil != err {
+			t.Errorf("Unexpected Shutdown result: %v", err)
+		}
+
+		if 1 != envelope.commitCalls {
+			t.Errorf("Transaction was not committed in attempt %v", i)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestServerShutdownDeadline(t *tst.T) {
+	envelope := &testEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	conn, reader, _ := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+		"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if context.DeadlineExceeded != err {
+		t.Errorf("Unexpected Shutdown result: %v", err)
+	}
+
+	server.Wait()
+
+	line, err := reader.ReadString('\n')
+	if "" != line || nil == err {
+		t.Errorf("Connection was not closed: %q %v", line, err)
+	}
+
+	if 0 != envelope.commitCalls || 1 != envelope.discardCalls {
+		t.Errorf("Transaction was not discarded: %v %v", envelope.commitCalls, envelope.discardCalls)
+	}
+}
+
+func TestServerShutdownDeadlineStreaming(t *tst.T) {
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+
+	envelope := &testStreamEnvelope{
+		onData: func(ctx context.Context, env *testStreamEnvelope, r io.Reader) error {
+			// never reads the content
+			<-ctx.Done()
+			close(cancelled)
+			<-release
+
+			return nil
+		},
+	}
+
+	discarded := make(chan struct{})
+	envelope.onDiscard = func(ctx context.Context, env *testEnvelope) error {
+		close(discarded)
+
+		return nil
+	}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	conn, reader, _ := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+		"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+	})
+
+	conn.Write([]byte("hello\r\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if context.DeadlineExceeded != err {
+		t.Errorf("Unexpected Shutdown result: %v", err)
+	}
+
+	waited := make(chan struct{})
+
+	go func() {
+		server.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Dialog blocked on Data after Shutdown")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Context of Data was not cancelled")
+	}
+
+	if 0 != envelope.discardCalls {
+		t.Errorf("Envelope discarded before Data returned")
+	}
+
+	close(release)
+
+	select {
+	case <-discarded:
+	case <-time.After(time.Second):
+		t.Errorf("Envelope not discarded once Data returned")
+	}
+}
+
+func TestServerServeTLS(t *tst.T) {
+	viaTLS := false
+
+	server := NewServer(Config{
+		TLS:    testTLSConfig(t),
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			viaTLS = sess.ViaTLS()
+
+			return &testEnvelope{}, nil
+		},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.ServeTLS(ctx, listener)
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if nil != err {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	testServerDialog(t, conn, bufio.NewReader(conn), []string{
+		"", "220 example.com Service ready",
+		"EHLO domain.com", "250-example.com greetings",
+		"", "250-8BITMIME",
+		"", "250-SIZE",
+		"", "250-PIPELINING",
+		"", "250-CHUNKING",
+		"", "250-BINARYMIME",
+		"", "250-SMTPUTF8",
+		"", "250-DSN",
+		"", "250 ENHANCEDSTATUSCODES",
+		"STARTTLS", "502 5.5.1 Command not implemented",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"QUIT", "221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	conn.Close()
+	cancel()
+
+	err = <-served
+	if ErrServerClosed != err {
+		t.Errorf("Unexpected Serve result: %v", err)
+	}
+
+	server.Wait()
+
+	if !viaTLS {
+		t.Errorf("Session was not via TLS")
+	}
+}
+
+func TestServerServeTLSWithoutConfig(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	err := server.ListenAndServeTLS(context.Background(), "127.0.0.1:0")
+	if ErrServeTLSWithoutConfig != err {
+		t.Errorf("Unexpected ListenAndServeTLS result: %v", err)
+	}
+
+	conn := testServerConn()
+
+	err = server.AcceptTLS(context.Background(), conn, nil)
+	if ErrServeTLSWithoutConfig != err || 1 != conn.closeCalls {
+		t.Errorf("Unexpected AcceptTLS result: %v", err)
+	}
+
+	server.Wait()
+}
+
+func TestServerTimeouts(t *tst.T) {
+	examples := []struct {
+		Timeouts Timeouts
+		Dialog   []string
+	}{
+		{
+			Timeouts: Timeouts{
+				Greeting: 50 * time.Millisecond,
+			},
+			Dialog: []string{
+				"", "220 example.com Service ready",
+			},
+		},
+		{
+			Timeouts: Timeouts{
+				Command: 50 * time.Millisecond,
+			},
+			Dialog: []string{
+				"", "220 example.com Service ready",
+				"HELO domain.com", "250 example.com greetings",
+			},
+		},
+		{
+			Timeouts: Timeouts{
+				DATABlock: 50 * time.Millisecond,
+			},
+			Dialog: []string{
+				"", "220 example.com Service ready",
+				"HELO domain.com", "250 example.com greetings",
+				"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+				"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+				"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+				"hello\r\n.\r\nMAIL FROM:<someone@domain.com>\r\nRCPT TO:<someone@example.com>\r\nDATA\r\nhello", "250 2.0.0 Requested mail action okay, completed",
+				"", "250 2.1.0 Requested mail action okay, completed",
+				"", "250 2.1.5 Requested mail action okay, completed",
+				"", "354 Start mail input; end with <CRLF>.<CRLF>",
+			},
+		},
+	}
+
+	for _, ex := range examples {
+		server := NewServer(Config{
+			Domain:   "example.com",
+			Logger:   zap.NewExample(),
+			Timeouts: ex.Timeouts,
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				return &testEnvelope{}, nil
+			},
+		})
+
+		conn, reader, _ := testServerDial(t, server)
+
+		testServerDialog(t, conn, reader, append(ex.Dialog,
+			"", "421 4.3.2 example.com Service not available, closing transmission channel",
+		))
+
+		conn.Close()
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerCommitTimeout(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		Timeouts: Timeouts{
+			DATATermination: 50 * time.Millisecond,
+		},
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{
+				onCommit: func(ctx context.Context, env *testEnvelope) (CommitAction, error) {
+					<-ctx.Done()
+
+					return AcceptCommit, ctx.Err()
+				},
+			}, nil
+		},
+	})
+
+	conn, reader, _ := testServerDial(t, server)
+	defer conn.Close()
+
+	testServerDialog(t, conn, reader, []string{
+		"", "220 example.com Service ready",
+		"HELO domain.com", "250 example.com greetings",
+		"MAIL FROM:<someone@domain.com>", "250 2.1.0 Requested mail action okay, completed",
+		"RCPT TO:<someone@example.com>", "250 2.1.5 Requested mail action okay, completed",
+		"DATA", "354 Start mail input; end with <CRLF>.<CRLF>",
+		"hello\r\n.", "421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+
+	server.Shutdown(context.Background())
+}
+
+func TestServerMaxMessageSize(t *tst.T) {
+	envelopes := make([]*testEnvelope, 0, 3)
+
+	server := NewServer(Config{
+		Domain:         "example.com",
+		Logger:         zap.NewExample(),
+		MaxMessageSize: 16,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testEnvelope{}
+			envelopes = append(envelopes, envelope)
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"MAIL FROM:<someone@domain.com> SIZE=17",
+		"MAIL FROM:<someone@domain.com> SIZE=16",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello",
+		"..world",
+		"and more",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 7",
+		"hello",
+		"BDAT 12 LAST",
+		"0123456789",
+		"BDAT 6 LAST",
+		"more",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello!",
+		"..world",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE 16",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"552 5.3.4 message size exceeds fixed maximium message size",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"552 5.3.4 Requested mail action aborted: exceeded storage allocation",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 7 octets received",
+		"552 5.3.4 Requested mail action aborted: exceeded storage allocation",
+		"503 5.5.1 Bad sequence of commands",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 3 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	for i, envelope := range envelopes[:2] {
+		if 0 != envelope.commitCalls || 1 != envelope.discardCalls {
+			t.Errorf("Unexpected calls for envelope %v: %v commits, %v discards", i, envelope.commitCalls, envelope.discardCalls)
+		}
+	}
+
+	if 2 != envelopes[0].writeCalls {
+		t.Errorf("Unexpected number of writes beyond the limit: %v", envelopes[0].writeCalls)
+	}
+
+	if "hello!\r\n.world\r\n" != envelopes[2].data.String() || 1 != envelopes[2].commitCalls {
+		t.Errorf("Unexpected message at the limit: %q", envelopes[2].data.String())
+	}
+}
+
+func TestServerMaxReceivedHeaders(t *tst.T) {
+	envelopes := make([]*testEnvelope, 0, 3)
+
+	server := NewServer(Config{
+		Domain:             "example.com",
+		Logger:             zap.NewExample(),
+		MaxReceivedHeaders: 2,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testEnvelope{}
+			envelopes = append(envelopes, envelope)
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Received: from a",
+		"received: from b",
+		"Received: from c",
+		"",
+		"hello",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 18",
+		"Received: from a",
+		"BDAT 36 LAST",
+		"Received: from b",
+		"Received: from c",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Received: from a",
+		"Received: from b",
+		"",
+		"Received: from c",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"554 5.4.6 Transaction failed: routing loop detected",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 18 octets received",
+		"554 5.4.6 Transaction failed: routing loop detected",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 3 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	for i, envelope := range envelopes[:2] {
+		if 0 != envelope.commitCalls || 1 != envelope.discardCalls {
+			t.Errorf("Unexpected calls for looping envelope %v: %v commits, %v discards", i, envelope.commitCalls, envelope.discardCalls)
+		}
+	}
+
+	if 1 != envelopes[2].commitCalls {
+		t.Errorf("Envelope with Received headers in its body was not committed")
+	}
+}
+
+func TestServerMaxReceivedHeadersDisabled(t *tst.T) {
+	envelope := &testEnvelope{}
+
+	server := NewServer(Config{
+		Domain:             "example.com",
+		Logger:             zap.NewExample(),
+		MaxReceivedHeaders: -1,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Subject: no Received headers",
+		"",
+		"hello",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 1 != envelope.commitCalls {
+		t.Errorf("Unexpected number of commits: %v", envelope.commitCalls)
+	}
+}
+
+func TestServerLongLines(t *tst.T) {
+	stuffed := ".." + strings.Repeat("a", 898)
+	// the CR of this line ends a full buffer of pieces
+	long := strings.Repeat("b", 2*538-1)
+
+	lines := []string{
+		"HELO domain.com " + strings.Repeat("x", 500),
+		"HELO domain.com " + strings.Repeat("x", 2000),
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		stuffed,
+		long,
+		".",
+		"QUIT",
+	}
+
+	examples := []struct {
+		Tolerate bool
+		Expected []string
+		Data     string
+	}{
+		{
+			Tolerate: false,
+			Expected: []string{
+				"220 example.com Service ready",
+				"500 5.5.2 Line too long",
+				"500 5.5.2 Line too long",
+				"250 2.1.0 Requested mail action okay, completed",
+				"250 2.1.5 Requested mail action okay, completed",
+				"354 Start mail input; end with <CRLF>.<CRLF>",
+				"554 5.6.0 Transaction failed: line too long",
+				"221 2.0.0 example.com Service closing transmission channel",
+			},
+		},
+		{
+			Tolerate: true,
+			Expected: []string{
+				"220 example.com Service ready",
+				"250 example.com greetings",
+				"500 5.5.2 Line too long",
+				"250 2.1.0 Requested mail action okay, completed",
+				"250 2.1.5 Requested mail action okay, completed",
+				"354 Start mail input; end with <CRLF>.<CRLF>",
+				"250 2.0.0 Requested mail action okay, completed",
+				"221 2.0.0 example.com Service closing transmission channel",
+			},
+			Data: stuffed[1:] + "\r\n" + long + "\r\n",
+		},
+	}
+
+	// the whole input at once, and in pieces splitting the CRLFs
+	for _, pieceSize := range []int{0, 7} {
+		for _, ex := range examples {
+			var envelope *testEnvelope
+
+			server := NewServer(Config{
+				Domain:            "example.com",
+				Logger:            zap.NewExample(),
+				BufferSize:        538,
+				TolerateLongLines: ex.Tolerate,
+				NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+					envelope = &testEnvelope{}
+
+					return envelope, nil
+				},
+			})
+
+			conn := testServerConn(lines...)
+
+			if 0 != pieceSize {
+				conn.onRead = func(conn *testConn, bytes []byte) (int, error) {
+					if len(bytes) > pieceSize {
+						bytes = bytes[:pieceSize]
+					}
+
+					return conn.reader.Read(bytes)
+				}
+			}
+
+			server.Accept(context.Background(), conn, nil)
+			server.Wait()
+
+			if strings.Join(ex.Expected, "\r\n")+"\r\n" != conn.writer.String() {
+				t.Errorf("Unexpected output for tolerate %v in pieces of %v: %v", ex.Tolerate, pieceSize, conn.writer.String())
+			}
+
+			if ex.Tolerate {
+				if 1 != envelope.commitCalls || ex.Data != envelope.data.String() {
+					t.Errorf("Unexpected message for pieces of %v: %q", pieceSize, envelope.data.String())
+				}
+			} else if 0 != envelope.commitCalls || 1 != envelope.discardCalls {
+				t.Errorf("Unexpected calls for pieces of %v: %v commits, %v discards", pieceSize, envelope.commitCalls, envelope.discardCalls)
+			}
+		}
+	}
+}
+
+func TestServerBareLineEndings(t *tst.T) {
+	lines := []string{
+		"HELO domain.com",
+		"NOOP\nNOOP",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello\n.",
+		"MAIL FROM:<smuggled@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"smuggled\r.",
+		"one\r\n.\ntwo",
+		".",
+		"QUIT",
+	}
+
+	examples := []struct {
+		Policy   BareLineEndings
+		Expected []string
+		Data     string
+	}{
+		{
+			Policy: RejectBareLineEndings,
+			Expected: []string{
+				"220 example.com Service ready",
+				"250 example.com greetings",
+				"500 5.5.2 Bare CR or LF not allowed",
+				"250 2.1.0 Requested mail action okay, completed",
+				"250 2.1.5 Requested mail action okay, completed",
+				"354 Start mail input; end with <CRLF>.<CRLF>",
+				"554 5.5.2 Transaction failed: bare CR or LF not allowed",
+				"221 2.0.0 example.com Service closing transmission channel",
+			},
+		},
+		{
+			Policy: NormalizeBareLineEndings,
+			Expected: []string{
+				"220 example.com Service ready",
+				"250 example.com greetings",
+				"250 2.0.0 Requested mail action okay, completed",
+				"250 2.0.0 Requested mail action okay, completed",
+				"250 2.1.0 Requested mail action okay, completed",
+				"250 2.1.5 Requested mail action okay, completed",
+				"354 Start mail input; end with <CRLF>.<CRLF>",
+				"250 2.0.0 Requested mail action okay, completed",
+				"221 2.0.0 example.com Service closing transmission channel",
+			},
+			Data: "hello\r\n.\r\nMAIL FROM:<smuggled@domain.com>\r\nRCPT TO:<someone@example.com>\r\nDATA\r\nsmuggled\r\n.\r\none\r\n.\r\ntwo\r\n",
+		},
+		{
+			Policy: PassBareLineEndings,
+			Expected: []string{
+				"220 example.com Service ready",
+				"250 example.com greetings",
+				"500 5.5.2 Syntax error, command unrecognized",
+				"250 2.1.0 Requested mail action okay, completed",
+				"250 2.1.5 Requested mail action okay, completed",
+				"354 Start mail input; end with <CRLF>.<CRLF>",
+				"250 2.0.0 Requested mail action okay, completed",
+				"221 2.0.0 example.com Service closing transmission channel",
+			},
+			Data: "hello\n.\r\nMAIL FROM:<smuggled@domain.com>\r\nRCPT TO:<someone@example.com>\r\nDATA\r\nsmuggled\r.\r\none\r\n.\ntwo\r\n",
+		},
+	}
+
+	for _, ex := range examples {
+		envelopes := make([]*testEnvelope, 0, 1)
+
+		server := NewServer(Config{
+			Domain:          "example.com",
+			Logger:          zap.NewExample(),
+			BareLineEndings: ex.Policy,
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				envelope := &testEnvelope{}
+				envelopes = append(envelopes, envelope)
+
+				return envelope, nil
+			},
+		})
+
+		testServerExchange(t, server, lines, ex.Expected)
+
+		// the smuggled MAIL must never be read as a command
+		if 1 != len(envelopes) {
+			t.Fatalf("Unexpected number of envelopes for policy %v: %v", ex.Policy, len(envelopes))
+		}
+
+		if "" == ex.Data {
+			if 0 != envelopes[0].commitCalls || 1 != envelopes[0].discardCalls {
+				t.Errorf("Unexpected calls for policy %v: %v commits, %v discards", ex.Policy, envelopes[0].commitCalls, envelopes[0].discardCalls)
+			}
+		} else if 1 != envelopes[0].commitCalls || ex.Data != envelopes[0].data.String() {
+			t.Errorf("Unexpected message for policy %v: %q", ex.Policy, envelopes[0].data.String())
+		}
+	}
+}
+
+func TestServerHeaderEnvelope(t *tst.T) {
+	envelopes := make([]*testHeaderEnvelope, 0, 4)
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testHeaderEnvelope{
+				onHeader: func(ctx context.Context, env *testHeaderEnvelope, header Header) error {
+					if "yes" == header.Get("X-Spam") {
+						return Reply{Code: 554, Enhanced: "5.7.1", Lines: []string{"message looks like spam"}}
+					}
+
+					return nil
+				},
+			}
+			envelopes = append(envelopes, envelope)
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Subject: =?UTF-8?Q?caf=C3=A9?=",
+		"To: a@example.com,",
+		" b@example.com",
+		"",
+		"body",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"X-Spam: yes",
+		"",
+		"spam",
+		"more spam",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 18 LAST",
+		"Subject: no body",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 21",
+		"X-Spam: yes",
+		"",
+		"spam",
+		"BDAT 0 LAST",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"554 5.7.1 message looks like spam",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"554 5.7.1 message looks like spam",
+		"503 5.5.1 Bad sequence of commands",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 4 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	expected := []Header{
+		{
+			{"Subject", "=?UTF-8?Q?caf=C3=A9?=", "café"},
+			{"To", "a@example.com, b@example.com", "a@example.com, b@example.com"},
+		},
+		{{"X-Spam", "yes", "yes"}},
+		{{"Subject", "no body", "no body"}},
+		{{"X-Spam", "yes", "yes"}},
+	}
+
+	for i, envelope := range envelopes {
+		if 1 != len(envelope.headers) || !reflect.DeepEqual(expected[i], envelope.headers[0]) {
+			t.Errorf("Unexpected header for envelope %v: %v", i, envelope.headers)
+		}
+	}
+
+	for i, commits := range []int{1, 0, 1, 0} {
+		if commits != envelopes[i].commitCalls || 1-commits != envelopes[i].discardCalls {
+			t.Errorf("Unexpected calls for envelope %v: %v commits, %v discards", i, envelopes[i].commitCalls, envelopes[i].discardCalls)
+		}
+	}
+
+	if 2 != envelopes[1].writeCalls {
+		t.Errorf("Unexpected writes after the header was rejected: %v", envelopes[1].writeCalls)
+	}
+}
+
+func TestServerHeaderEnvelopeBareLineEndings(t *tst.T) {
+	envelopes := make([]*testHeaderEnvelope, 0, 2)
+
+	server := NewServer(Config{
+		Domain:             "example.com",
+		Logger:             zap.NewExample(),
+		BareLineEndings:    PassBareLineEndings,
+		MaxReceivedHeaders: 1,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testHeaderEnvelope{}
+			envelopes = append(envelopes, envelope)
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Received: from a\nSubject: bare\n\nReceived: from b\nbody",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"Received: from a\nReceived: from b\n\nbody",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"554 5.4.6 Transaction failed: routing loop detected",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 2 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	expected := Header{
+		{"Received", "from a", "from a"},
+		{"Subject", "bare", "bare"},
+	}
+
+	if 1 != len(envelopes[0].headers) || !reflect.DeepEqual(expected, envelopes[0].headers[0]) {
+		t.Errorf("Unexpected header: %v", envelopes[0].headers)
+	}
+
+	if 1 != envelopes[0].commitCalls || 1 != envelopes[1].discardCalls {
+		t.Errorf("Unexpected calls: %v commits, %v discards", envelopes[0].commitCalls, envelopes[1].discardCalls)
+	}
+}
+
+func TestServerStreamEnvelope(t *tst.T) {
+	envelopes := make([]*testStreamEnvelope, 0, 4)
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testStreamEnvelope{}
+
+			if 2 == len(envelopes) {
+				envelope.onData = func(ctx context.Context, env *testStreamEnvelope, r io.Reader) error {
+					env.content = make([]byte, 4)
+					io.ReadFull(r, env.content)
+
+					return Reply{Code: 554, Enhanced: "5.7.1", Lines: []string{"message looks like spam"}}
+				}
+			}
+
+			envelopes = append(envelopes, envelope)
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello",
+		"..world",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 5",
+		"abc",
+		"BDAT 0 LAST",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"spam",
+		"spam",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 5",
+		"abc",
+		"RSET",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 5 octets received",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"554 5.7.1 message looks like spam",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 5 octets received",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 4 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	examples := []struct {
+		Content string
+		ReadErr error
+		Commits int
+	}{
+		{"hello\r\n.world\r\n", nil, 1},
+		{"abc\r\n", nil, 1},
+		{"spam", nil, 0},
+		{"abc\r\n", ErrContentAborted, 0},
+	}
+
+	for i, ex := range examples {
+		envelope := envelopes[i]
+
+		if 1 != envelope.dataCalls || ex.Content != string(envelope.content) || ex.ReadErr != envelope.readErr {
+			t.Errorf("Unexpected content of envelope %v: %q %v", i, envelope.content, envelope.readErr)
+		}
+
+		if 0 != envelope.writeCalls || ex.Commits != envelope.commitCalls || 1-ex.Commits != envelope.discardCalls {
+			t.Errorf("Unexpected calls for envelope %v: %v writes, %v commits, %v discards", i, envelope.writeCalls, envelope.commitCalls, envelope.discardCalls)
+		}
+	}
+}
+
+func TestServerTraceHeaders(t *tst.T) {
+	envelopes := make([]*testEnvelope, 0, 2)
+	id := ""
+
+	server := NewServer(Config{
+		Domain:           "example.com",
+		Logger:           zap.NewExample(),
+		ReceivedHeader:   true,
+		ReturnPathHeader: true,
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			envelope := &testEnvelope{}
+			envelopes = append(envelopes, envelope)
+			id = sess.ID
+
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello",
+		".",
+		"MAIL FROM:<>",
+		"RCPT TO:<someone@example.com>",
+		"RCPT TO:<other@example.com>",
+		"BDAT 5 LAST",
+		"abc",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 2 != len(envelopes) {
+		t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+	}
+
+	examples := []struct {
+		Prefix  string
+		Content string
+	}{
+		{
+			Prefix:  "Return-Path: <someone@domain.com>\r\nReceived: from domain.com ([127.0.0.2])\r\n\tby example.com with SMTP id " + id + "\r\n\tfor <someone@example.com>; ",
+			Content: "hello\r\n",
+		},
+		{
+			Prefix:  "Return-Path: <>\r\nReceived: from domain.com ([127.0.0.2])\r\n\tby example.com with SMTP id " + id + "; ",
+			Content: "abc\r\n",
+		},
+	}
+
+	for i, ex := range examples {
+		data := envelopes[i].data.String()
+		date := strings.TrimSuffix(strings.TrimPrefix(data, ex.Prefix), "\r\n"+ex.Content)
+
+		if _, err := time.Parse(time.RFC1123Z, date); nil != err || !strings.HasPrefix(data, ex.Prefix) {
+			t.Errorf("Unexpected trace headers for message %v: %q", i, data)
+		}
+	}
+}
+
+func TestServerEnvelopeReplies(t *tst.T) {
+	commits := 0
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{
+				onFrom: func(ctx context.Context, env *testEnvelope, addr []byte) (FromAction, error) {
+					if "greylisted@domain.com" == string(addr) {
+						return AcceptFROM, Reply{Code: 451, Enhanced: "4.7.1", Lines: []string{"greylisted, try again in 5 minutes"}}
+					}
+
+					if "spoofed@domain.com" == string(addr) {
+						return AcceptFROM, &Reply{Code: 550, Enhanced: "5.7.1", Lines: []string{"sender\r\n250 injected"}}
+					}
+
+					return RejectFROMPermanently, Reply{Code: 250, Enhanced: "2.1.0", Lines: []string{"sender " + string(addr) + " ok"}}
+				},
+				onTo: func(ctx context.Context, env *testEnvelope, addr []byte) (ToAction, error) {
+					if "nobody@example.com" == string(addr) {
+						return AcceptTO, fmt.Errorf("lookup: %w", Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{string(addr) + " does not exist", "check the address"}})
+					}
+
+					return AcceptTO, nil
+				},
+				onCommit: func(ctx context.Context, env *testEnvelope) (CommitAction, error) {
+					commits += 1
+
+					return RejectCommitPermanently, Reply{Code: 250, Enhanced: "2.0.0", Lines: []string{"queued as 1234"}}
+				},
+			}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<greylisted@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"MAIL FROM:<spoofed@domain.com>",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<nobody@example.com>",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"hello",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"451 4.7.1 greylisted, try again in 5 minutes",
+		"503 5.5.1 Bad sequence of commands",
+		"550 5.7.1 sender  250 injected",
+		"250 2.1.0 sender someone@domain.com ok",
+		"550-5.1.1 nobody@example.com does not exist",
+		"550 5.1.1 check the address",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 queued as 1234",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 1 != commits {
+		t.Errorf("Unexpected number of commits: %v", commits)
+	}
+}
+
+func TestServerEnvelopeReplyClosing(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{
+				onTo: func(ctx context.Context, env *testEnvelope, addr []byte) (ToAction, error) {
+					return AcceptTO, &Reply{Code: 421, Enhanced: "4.3.2", Lines: []string{"example.com going down"}}
+				},
+			}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"NOOP",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"421 4.3.2 example.com going down",
+	})
+}
+
+func TestServerEnvelopeReplyInvalid(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{
+				onFrom: func(ctx context.Context, env *testEnvelope, addr []byte) (FromAction, error) {
+					if "malformed@domain.com" == string(addr) {
+						return AcceptFROM, Reply{Code: 1234, Lines: []string{"malformed"}}
+					}
+
+					return AcceptFROM, nil
+				},
+				onTo: func(ctx context.Context, env *testEnvelope, addr []byte) (ToAction, error) {
+					return AcceptTO, Reply{Code: 354, Lines: []string{"go ahead"}}
+				},
+			}, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<malformed@domain.com>",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"250 2.1.0 Requested mail action okay, completed",
+		"421 4.3.2 example.com Service not available, closing transmission channel",
+	})
+}
+
+func testServerConn(lines ...string) *testConn {
+	conn := &testConn{
+		remote: &testAddr{
+			network: "tcp",
+			address: "127.0.0.2:2938",
+		},
+		local: &testAddr{
+			network: "tcp",
+			address: "127.0.0.1:25",
+		},
+		reader: bytes.NewBuffer(make([]byte, 0, 1024)),
+		writer: bytes.NewBuffer(make([]byte, 0, 1024)),
+	}
+
+	conn.reader.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+
+	return conn
+}
+
+func TestServerCommandEnvelope(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	conn := testServerConn(
+		"EHLO domain.com",
+		"MAIL FROM:<@relay.com:\"some one\"@domain.com>",
+		"RCPT TO:<postmaster>",
+		"RCPT TO:<someone@[IPv6:2001:db8::1]>",
+		"QUIT",
+	)
+
+	server.Accept(context.Background(), conn, nil)
+	server.Wait()
+
+	expected := []Path{
+		{
+			Route:     []string{"relay.com"},
+			LocalPart: "some one",
+			Domain:    "domain.com",
+		},
+		{
+			LocalPart: "postmaster",
+		},
+		{
+			LocalPart: "someone",
+			Literal:   "IPv6:2001:db8::1",
+		},
+	}
+
+	if 1 != len(envelope.mails) || 2 != len(envelope.rcpts) {
+		t.Fatalf("Unexpected number of calls: %v %v", len(envelope.mails), len(envelope.rcpts))
+	}
+
+	paths := []Path{envelope.mails[0].From, envelope.rcpts[0].To, envelope.rcpts[1].To}
+
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Unexpected paths: %#v", paths)
+	}
+
+	if nil != envelope.from || 1 != envelope.sizeCalls {
+		t.Errorf("Unexpected envelope state: %q %v", envelope.from, envelope.sizeCalls)
+	}
+}
+
+func testServerExchange(t *tst.T, server *Server, lines []string, expected []string) {
+	conn := testServerConn(lines...)
+
+	server.Accept(context.Background(), conn, nil)
+	server.Wait()
+
+	result := string(conn.writer.Bytes())
+
+	if strings.Join(expected, "\r\n")+"\r\n" != result {
+		t.Errorf("Unexpected output: %v", result)
+	}
+}
+
+func TestServerParams(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"MAIL FROM:<someone@domain.com> X-UNKNOWN=1",
+		"MAIL FROM:<someone@domain.com> SIZE=abc",
+		"MAIL FROM:<someone@domain.com> SIZE=123 BODY=8BITMIME",
+		"RCPT TO:<someone@example.com> X-UNKNOWN",
+		"RCPT TO:<someone@example.com> ==",
+		"RCPT TO:<someone@example.com>",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.0 Requested mail action okay, completed",
+		"555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.5 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 1 != len(envelope.mails) || !reflect.DeepEqual(Params{"SIZE": "123", "BODY": "8BITMIME"}, envelope.mails[0].Params) {
+		t.Errorf("Unexpected MAIL params: %v", envelope.mails)
+	}
+
+	if 1 != len(envelope.rcpts) || 0 != len(envelope.rcpts[0].Params) {
+		t.Errorf("Unexpected RCPT params: %v", envelope.rcpts)
+	}
+}
+
+func TestServerPipelining(t *tst.T) {
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return &testEnvelope{}, nil
+		},
+	})
+
+	conn := testServerConn(
+		"EHLO domain.com",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"RCPT TO:<other@example.com>",
+		"DATA",
+		"hello",
+		".",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"RSET",
+		"QUIT",
+	)
+
+	server.Accept(context.Background(), conn, nil)
+	server.Wait()
+
+	expected := []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	}
+
+	if strings.Join(expected, "\r\n")+"\r\n" != conn.writer.String() {
+		t.Errorf("Unexpected output: %v", conn.writer.String())
+	}
+
+	// greeting, EHLO, the group up to DATA and the group up to QUIT
+	if 4 != conn.writeCalls {
+		t.Errorf("Unexpected number of writes: %v", conn.writeCalls)
+	}
+}
+
+func TestServerBDAT(t *tst.T) {
+	lines := []string{
+		"BDAT 6",
+		"QUIT",
+		"EHLO domain.com",
+		"BDAT abc",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 7",
+		"hello",
+		"DATA",
+		"BDAT 0",
+		"BDAT 10 LAST",
+		"QUIT",
+		"..",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<someone@example.com>",
+		"BDAT 0 last",
+		"QUIT",
+	}
+
+	expected := []string{
+		"220 example.com Service ready",
+		"503 5.5.1 Bad sequence of commands",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 7 octets received",
+		"503 5.5.1 Bad sequence of commands",
+		"250 2.0.0 7 octets received",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	}
+
+	// the whole input at once, and in pieces splitting the chunks
+	for _, pieceSize := range []int{0, 3} {
+		envelopes := make([]*testEnvelope, 0, 2)
+
+		server := NewServer(Config{
+			Domain: "example.com",
+			Logger: zap.NewExample(),
+			NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+				envelope := &testEnvelope{}
+				envelopes = append(envelopes, envelope)
+
+				return envelope, nil
+			},
+		})
+
+		conn := testServerConn(lines...)
+
+		if 0 != pieceSize {
+			conn.onRead = func(conn *testConn, bytes []byte) (int, error) {
+				if len(bytes) > pieceSize {
+					bytes = bytes[:pieceSize]
+				}
+
+				return conn.reader.Read(bytes)
+			}
+		}
+
+		server.Accept(context.Background(), conn, nil)
+		server.Wait()
+
+		if strings.Join(expected, "\r\n")+"\r\n" != conn.writer.String() {
+			t.Errorf("Unexpected output for pieces of %v: %v", pieceSize, conn.writer.String())
+		}
+
+		if 2 != len(envelopes) {
+			t.Fatalf("Unexpected number of envelopes: %v", len(envelopes))
+		}
+
+		if "hello\r\nQUIT\r\n..\r\n" != envelopes[0].data.String() || 1 != envelopes[0].commitCalls {
+			t.Errorf("Unexpected first message: %q", envelopes[0].data.String())
+		}
+
+		if 0 != envelopes[1].data.Len() || 1 != envelopes[1].commitCalls {
+			t.Errorf("Unexpected second message: %q", envelopes[1].data.String())
+		}
+	}
+}
+
+func TestServerBINARYMIME(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"MAIL FROM:<someone@domain.com> BODY=BINARYMIME",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		"BDAT 5 LAST",
+		"abc",
+		"MAIL FROM:<someone@domain.com> BODY=8BITMIME",
+		"RCPT TO:<someone@example.com>",
+		"DATA",
+		".",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"503 5.5.1 BINARYMIME content must be sent with BDAT",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"354 Start mail input; end with <CRLF>.<CRLF>",
+		"250 2.0.0 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 2 != len(envelope.mails) || BodyBINARYMIME != envelope.mails[0].Body || Body8BITMIME != envelope.mails[1].Body {
+		t.Errorf("Unexpected MAIL body types: %v", envelope.mails)
+	}
+}
+
+func TestServerSMTPUTF8(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"EHLO domain.com",
+		"MAIL FROM:<jöran@bücher.example>",
+		"MAIL FROM:<someone@domain.com> SMTPUTF8=YES",
+		"MAIL FROM:<jöran@bücher.example> SMTPUTF8",
+		"RCPT TO:<用户@例子.广告>",
+		"RSET",
+		"MAIL FROM:<someone@domain.com>",
+		"RCPT TO:<用户@例子.广告>",
+		"RCPT TO:<someone@xn--fsqu00a.xn--4rr70v>",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250-example.com greetings",
+		"250-8BITMIME",
+		"250-SIZE",
+		"250-PIPELINING",
+		"250-CHUNKING",
+		"250-BINARYMIME",
+		"250-SMTPUTF8",
+		"250-DSN",
+		"250 ENHANCEDSTATUSCODES",
+		"553 5.6.7 Non-ASCII addresses require SMTPUTF8",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.0 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.0.0 Requested mail action okay, completed",
+		"250 2.1.0 Requested mail action okay, completed",
+		"553 5.6.7 Non-ASCII addresses require SMTPUTF8",
+		"250 2.1.5 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 2 != len(envelope.mails) || !envelope.mails[0].UTF8 || envelope.mails[1].UTF8 {
+		t.Errorf("Unexpected MAIL UTF8 flags: %v", envelope.mails)
+	}
+
+	if 2 != len(envelope.rcpts) || "例子.广告" != envelope.rcpts[0].To.Domain || "例子.广告" != envelope.rcpts[1].To.DomainUnicode() {
+		t.Errorf("Unexpected RCPT paths: %v", envelope.rcpts)
+	}
+}
+
+func TestServerDSN(t *tst.T) {
+	envelope := &testCommandEnvelope{}
+
+	server := NewServer(Config{
+		Domain: "example.com",
+		Logger: zap.NewExample(),
+		NewEnvelope: func(ctx context.Context, sess *Session) (Envelope, error) {
+			return envelope, nil
+		},
+	})
+
+	testServerExchange(t, server, []string{
+		"HELO domain.com",
+		"MAIL FROM:<someone@domain.com> RET=ALL",
+		"MAIL FROM:<someone@domain.com> RET=HDRS ENVID=QQ+2B314159",
+		"RCPT TO:<someone@example.com> NOTIFY=NEVER,DELAY",
+		"RCPT TO:<someone@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;other+2Bone@example.com",
+		"RCPT TO:<somebody@example.com>",
+		"QUIT",
+	}, []string{
+		"220 example.com Service ready",
+		"250 example.com greetings",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.0 Requested mail action okay, completed",
+		"501 5.5.4 Syntax error in parameters or arguments",
+		"250 2.1.5 Requested mail action okay, completed",
+		"250 2.1.5 Requested mail action okay, completed",
+		"221 2.0.0 example.com Service closing transmission channel",
+	})
+
+	if 1 != len(envelope.mails) || ReturnHeaders != envelope.mails[0].Return || "QQ+314159" != envelope.mails[0].EnvelopeID {
+		t.Errorf("Unexpected MAIL DSN parameters: %v", envelope.mails)
+	}
+
+	if 2 != len(envelope.rcpts) {
+		t.Fatalf("Unexpected number of RCPT calls: %v", len(envelope.rcpts))
+	}
+
+	first, second := envelope.rcpts[0], envelope.rcpts[1]
+
+	if NotifyFailure|NotifyDelay != first.Notify || "RFC822" != first.OriginalRecipientType || "other+one@example.com" != first.OriginalRecipient {
+		t.Errorf("Unexpected RCPT DSN parameters: %v", first)
+	}
+
+	if 0 != second.Notify || "" != second.OriginalRecipientType || "" != second.OriginalRecipient {
+		t.Errorf("Unexpected RCPT DSN parameters: %v", second)
+	}
+}
@@ -3,12 +3,9 @@ package smtp
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"go.uber.org/zap"
-)
-
-var (
-	extensionsTLS   = "250-8BITMIME\r\n250-SIZE\r\n250 STARTTLS\r\n"
-	extensionsNoTLS = "250-8BITMIME\r\n250 SIZE\r\n"
+	"time"
 )
 
 type envelopeState = int
@@ -18,14 +15,46 @@ const (
 	envelopeCreated                  = iota
 	envelopeRecipients               = iota
 	envelopeData                     = iota
+	envelopeChunks                   = iota
 )
 
 type sessionState struct {
-	domain []byte
-	tls    bool
-
-	env      Envelope
-	envState envelopeState
+	started  bool
+	domain   []byte
+	extended bool
+	tls      bool
+	tlsState *tls.ConnectionState
+
+	identity string
+	auth     MechanismExchange
+
+	env        Envelope
+	envState   envelopeState
+	from       Path
+	recipients []Path
+	body       BodyType
+	utf8       bool
+	dataSize   uint64
+
+	// octets of the current BDAT chunk still to be read, and the reply sent
+	// instead of accepting the chunk once it has been read
+	chunkSize  uint64
+	chunkLast  bool
+	chunkReply Reply
+
+	// octets of the current line already passed in pieces, and whether the
+	// last line of content ended with a bare LF
+	lineLength  uint64
+	bareLineEnd bool
+
+	// the reply sent instead of committing the content once it has been read
+	contentReply Reply
+
+	// the content streamed to a StreamEnvelope
+	stream *contentStream
+
+	// the header section of the content
+	header headerSection
 }
 
 func (st sessionState) inEHLO() bool {
@@ -48,11 +77,52 @@ func (st sessionState) inDATA() bool {
 	return envelopeData == st.envState
 }
 
-func (st sessionState) Discard(ctx context.Context) error {
-	env := st.env
+func (st sessionState) inBDAT() bool {
+	return envelopeChunks == st.envState
+}
 
+// Ends the transaction without discarding the envelope.
+func (st *sessionState) reset() {
 	st.env = nil
 	st.envState = envelopeBlank
+	st.from = Path{}
+	st.recipients = nil
+	st.body = Body7BIT
+	st.utf8 = false
+	st.dataSize = 0
+	st.bareLineEnd = false
+	st.contentReply = Reply{}
+	st.stream = nil
+	st.header = headerSection{}
+}
+
+// Starts streaming the content if the envelope is a StreamEnvelope, and
+// collecting its header section if it is a HeaderEnvelope.
+func (st *sessionState) startContent(ctx context.Context) {
+	if streamEnv, ok := st.env.(StreamEnvelope); ok {
+		st.stream = startContentStream(ctx, streamEnv)
+	}
+
+	_, st.header.collect = st.env.(HeaderEnvelope)
+}
+
+func (st *sessionState) Discard(ctx context.Context) error {
+	env := st.env
+	stream := st.stream
+
+	st.reset()
+
+	// the error of Data is expected once the content is aborted
+	if nil != stream && !stream.abort() {
+		// the session is killed while Data is still running, which it does
+		// not wait for, so the envelope is discarded once Data returns
+		go func() {
+			<-stream.done
+			env.Discard(ctx)
+		}()
+
+		return nil
+	}
 
 	if nil != env {
 		return env.Discard(ctx)
@@ -67,6 +137,22 @@ type sessionConfig struct {
 	tls         bool
 	tlsRequired bool
 
+	mechanisms   []Mechanism
+	insecureAuth bool
+
+	receivedHeader   bool
+	returnPathHeader bool
+
+	maxReceivedHeaders int
+
+	maxMessageSize    uint64
+	tolerateLongLines bool
+	bareLineEndings   BareLineEndings
+
+	commitTimeout time.Duration
+
+	extensions []Extension
+
 	newEnvelope func(ctx context.Context, sess *Session) (Envelope, error)
 
 	logger *zap.Logger
@@ -96,97 +182,415 @@ func (sess *Session) ViaTLS() bool {
 	return sess.state.tls
 }
 
+// State of the TLS connection, or nil if the session is not over TLS.
+func (sess *Session) TLSConnectionState() *tls.ConnectionState {
+	return sess.state.tlsState
+}
+
+// Identity the client has authenticated as with the AUTH command. Will be
+// empty if the client has not authenticated.
+func (sess *Session) Identity() string {
+	return sess.state.identity
+}
+
 type sessionAction = uint
 
 const (
 	keepSession    sessionAction = iota
 	closeSession                 = iota
 	upgradeSession               = iota
+	flushSession                 = iota
+)
+
+type sessionPhase = int
+
+const (
+	phaseGreeting       sessionPhase = iota
+	phaseCommand                     = iota
+	phaseMAIL                        = iota
+	phaseRCPT                        = iota
+	phaseDATAInitiation              = iota
+	phaseDATABlock                   = iota
 )
 
-func (sess *Session) greet(ctx context.Context) []byte {
+var phaseNames = map[sessionPhase]string{
+	phaseGreeting:       "greeting",
+	phaseCommand:        "command",
+	phaseMAIL:           "MAIL",
+	phaseRCPT:           "RCPT",
+	phaseDATAInitiation: "DATA initiation",
+	phaseDATABlock:      "DATA block",
+}
+
+// The phase of the dialog the session is in while waiting for input.
+func (sess *Session) phase() sessionPhase {
+	switch {
+	case !sess.state.started:
+		return phaseGreeting
+
+	case sess.state.inMAIL():
+		return phaseMAIL
+
+	case sess.state.inRCPT():
+		return phaseRCPT
+
+	case sess.state.inDATA():
+		if 0 == sess.state.dataSize {
+			return phaseDATAInitiation
+		}
+
+		return phaseDATABlock
+
+	case sess.state.inBDAT(), sess.chunkPending():
+		return phaseDATABlock
+	}
+
+	return phaseCommand
+}
+
+func (sess *Session) greet(ctx context.Context) Reply {
 	return replyServiceReady(sess.config.domain)
 }
 
-func (sess *Session) kill(ctx context.Context) ([]byte, error) {
+func (sess *Session) kill(ctx context.Context) (Reply, error) {
 	return replyServiceNotAvailable(sess.config.domain), sess.state.Discard(ctx)
 }
 
-func (sess *Session) advance(ctx context.Context, line []byte) ([]byte, sessionAction, error) {
+// Maximum lengths of lines including the CRLF, RFC 5321 section 4.5.3.1.
+const (
+	commandLineLimit = 512
+	textLineLimit    = 1000
+)
+
+// Advance the session with a line, which ends a line passed in pieces before
+// if there was one.
+func (sess *Session) advance(ctx context.Context, line []byte) (Reply, sessionAction, error) {
+	sess.state.started = true
+
+	continued := 0 != sess.state.lineLength
+	length := sess.state.lineLength + uint64(len(line))
+	sess.state.lineLength = 0
+
+	bareLineEnd := !bytes.HasSuffix(line, crlf)
+	if bareLineEnd {
+		// only when normalizing, the line is handled as if it ended with CRLF
+		line = append(line[:len(line)-1:len(line)-1], crlf...)
+	}
+
+	bare := hasBareLineEnding(line) && PassBareLineEndings != sess.config.bareLineEndings
+
 	if sess.state.inDATA() {
-		return sess.processContent(ctx, line)
+		if length > textLineLimit && !sess.config.tolerateLongLines {
+			// the rest of the content is read but discarded until the end
+			sess.rejectContent(replyDATALineTooLong)
+
+			return Reply{}, keepSession, nil
+		}
+
+		return sess.processContent(ctx, line, continued, bareLineEnd)
+	} else if nil != sess.state.auth {
+		// responses are only limited by the buffer, RFC 4954
+		if continued {
+			sess.state.auth = nil
+
+			return replyAnyLineTooLong, flushSession, nil
+		}
+
+		if bare {
+			sess.state.auth = nil
+
+			return replyAnyBareLineEnding, flushSession, nil
+		}
+
+		reply, action, err := sess.processAUTHResponse(ctx, line)
+		if keepSession == action {
+			// the client waits for the challenge or outcome
+			action = flushSession
+		}
+
+		return reply, action, err
 	} else {
+		if continued || (length > commandLineLimit && !sess.config.tolerateLongLines) {
+			return replyAnyLineTooLong, keepSession, nil
+		}
+
+		if bare {
+			return replyAnyBareLineEnding, keepSession, nil
+		}
+
 		return sess.processCommand(ctx, line)
 	}
 }
 
+// Advance the session with a piece of a line too long for the buffer, the
+// rest of which follows in more pieces or a line.
+func (sess *Session) advancePiece(ctx context.Context, piece []byte) (Reply, sessionAction, error) {
+	sess.state.started = true
+
+	first := 0 == sess.state.lineLength
+	sess.state.lineLength += uint64(len(piece))
+
+	if !sess.state.inDATA() {
+		// commands are rejected once the end of the line has been read
+		return Reply{}, keepSession, nil
+	}
+
+	if sess.state.lineLength > textLineLimit && !sess.config.tolerateLongLines {
+		sess.rejectContent(replyDATALineTooLong)
+
+		return Reply{}, keepSession, nil
+	}
+
+	piece, ok := sess.normalizeContent(piece)
+	if !ok {
+		return Reply{}, keepSession, nil
+	}
+
+	if first && bytes.HasPrefix(piece, escapeDotPrefix) {
+		piece = piece[1:]
+	}
+
+	return sess.writeContent(ctx, piece)
+}
+
+// Rejects the content of the message with the reply once its end has been
+// read, unless it has already been rejected.
+func (sess *Session) rejectContent(reply Reply) {
+	if 0 == sess.state.contentReply.Code {
+		sess.state.contentReply = reply
+	}
+}
+
 var (
 	endOfData       = []byte(".\r\n")
 	escapeDotPrefix = []byte("..")
 )
 
-func (sess *Session) processContent(ctx context.Context, line []byte) ([]byte, sessionAction, error) {
-	if bytes.Equal(line, endOfData) {
-		action, err := sess.state.env.Commit(ctx)
-		if nil != err {
-			sess.config.logger.Warn("commit failed", zap.Error(err))
+// Advance the content of the message with a line, which is the end of a line
+// passed in pieces if continued.
+func (sess *Session) processContent(ctx context.Context, line []byte, continued, bareLineEnd bool) (Reply, sessionAction, error) {
+	// the final dot must be on a line of its own, preceded and followed by
+	// CRLF, RFC 5321 section 4.1.1.4
+	end := !continued && !bareLineEnd && !sess.state.bareLineEnd && bytes.Equal(line, endOfData)
+	sess.state.bareLineEnd = bareLineEnd
+
+	if end {
+		if reply := sess.state.contentReply; 0 != reply.Code {
+			return reply, keepSession, sess.state.Discard(ctx)
+		}
 
-			return replyDATATransactionFailed, keepSession, err
+		if sess.exceedsMaxMessageSize(0) {
+			return replyDATARejectSizePermanent, keepSession, sess.state.Discard(ctx)
 		}
 
-		sess.state.env = nil
-		sess.state.envState = envelopeBlank
+		return sess.commit(ctx)
+	} else {
+		write, ok := sess.normalizeContent(line)
+		if !ok {
+			return Reply{}, keepSession, nil
+		}
 
-		switch action {
-		case AcceptCommit:
-			break
+		if !continued && bytes.HasPrefix(write, escapeDotPrefix) {
+			write = write[1:]
+		}
 
-		case RejectCommitPermanently:
-			return replyDATARejectPermanent, keepSession, err
+		return sess.writeContent(ctx, write)
+	}
+}
 
-		case RejectCommitForTooManyRecipients:
-			return replyDATARejectNumberRecipients, keepSession, err
+// Applies the policy for bare CR and LF to content, returning false if the
+// content is rejected.
+func (sess *Session) normalizeContent(content []byte) ([]byte, bool) {
+	if PassBareLineEndings == sess.config.bareLineEndings || !hasBareLineEnding(content) {
+		return content, true
+	}
 
-		case RejectCommitTemporarilyForSizeExceeded:
-			return replyDATARejectSizeTemporary, keepSession, err
+	if RejectBareLineEndings == sess.config.bareLineEndings {
+		// the rest of the content is read but discarded until the end
+		sess.rejectContent(replyDATABareLineEnding)
 
-		case RejectCommitPermanentlyForSizeExceeded:
-			return replyDATARejectSizePermanent, keepSession, err
+		return nil, false
+	}
 
-		default:
-			return replyDATARejectTemporary, keepSession, err
-		}
+	ending := bytes.HasSuffix(content, crlf)
+	if ending {
+		content = content[:len(content)-2]
+	}
 
-		return replyAnyOk, keepSession, err
-	} else {
-		write := line
+	normalized := make([]byte, 0, len(content)+8)
 
-		if bytes.HasPrefix(line, escapeDotPrefix) {
-			write = line[1:]
+	// without its line ending the content has no CRLF, so any CR or LF is bare
+	for _, c := range content {
+		if '\r' == c || '\n' == c {
+			normalized = append(normalized, crlf...)
+		} else {
+			normalized = append(normalized, c)
 		}
+	}
+
+	if ending {
+		normalized = append(normalized, crlf...)
+	}
+
+	return normalized, true
+}
+
+// Writes unstuffed content to the envelope, unless it exceeds the maximum
+// message size.
+func (sess *Session) writeContent(ctx context.Context, write []byte) (Reply, sessionAction, error) {
+	exceeded := sess.exceedsMaxMessageSize(uint64(len(write)))
+	sess.state.dataSize += uint64(len(write))
+
+	if exceeded || 0 != sess.state.contentReply.Code {
+		// the rest of the content is read but discarded until the end
+		return Reply{}, keepSession, nil
+	}
+
+	err := sess.writeEnvelope(ctx, write)
+
+	if nil != err {
+		sess.config.logger.Warn("adding new line to envelope failed", zap.Error(err))
+
+		return replyServiceNotAvailable(sess.config.domain), closeSession, err
+	}
 
-		err := sess.state.env.Write(ctx, write)
+	if reply := sess.advanceHeader(ctx, write); 0 != reply.Code {
+		sess.rejectContent(reply)
+	}
+
+	return Reply{}, keepSession, nil
+}
+
+// Writes content to the envelope, or to its stream.
+func (sess *Session) writeEnvelope(ctx context.Context, content []byte) error {
+	if nil != sess.state.stream {
+		sess.state.stream.write(content)
+
+		return nil
+	}
+
+	return sess.state.env.Write(ctx, content)
+}
+
+// Whether adding the octets to the content of the message exceeds the maximum
+// message size.
+func (sess *Session) exceedsMaxMessageSize(octets uint64) bool {
+	max := sess.config.maxMessageSize
+
+	return 0 != max && (octets > max || sess.state.dataSize > max-octets)
+}
+
+// Commits the envelope at the end of the message content.
+func (sess *Session) commit(ctx context.Context) (Reply, sessionAction, error) {
+	if max := sess.config.maxReceivedHeaders; max >= 0 && sess.state.header.received > max {
+		sess.config.logger.Info("rejecting looping message", zap.Int("received", sess.state.header.received))
+
+		return replyDATARejectLoop, keepSession, sess.state.Discard(ctx)
+	}
+
+	if reply := sess.finishHeader(ctx); 0 != reply.Code {
+		return reply, keepSession, sess.state.Discard(ctx)
+	}
+
+	if nil != sess.state.stream {
+		err := sess.state.stream.close()
 
 		if nil != err {
-			sess.config.logger.Warn("adding new line to envelope failed", zap.Error(err))
+			reply, ok := envelopeReply(err, sess.config.logger)
+			if !ok {
+				sess.config.logger.Warn("streaming content failed", zap.Error(err))
 
-			return replyServiceNotAvailable(sess.config.domain), closeSession, err
+				reply = replyDATATransactionFailed
+			}
+
+			return reply, keepSession, sess.state.Discard(ctx)
 		}
 
-		return nil, keepSession, nil
+		sess.state.stream = nil
+	}
+
+	commitCtx := ctx
+
+	if sess.config.commitTimeout >= 0 {
+		var cancel context.CancelFunc
+
+		commitCtx, cancel = context.WithTimeout(ctx, sess.config.commitTimeout)
+		defer cancel()
+	}
+
+	action, err := sess.state.env.Commit(commitCtx)
+
+	if reply, ok := envelopeReply(err, sess.config.logger); ok {
+		sess.state.reset()
+
+		return reply, keepSession, nil
+	}
+
+	if nil != err {
+		if context.DeadlineExceeded == commitCtx.Err() {
+			sess.config.logger.Info("timeout", zap.String("phase", "DATA termination"), zap.Error(err))
+
+			return replyServiceNotAvailable(sess.config.domain), closeSession, sess.state.Discard(ctx)
+		}
+
+		sess.config.logger.Warn("commit failed", zap.Error(err))
+
+		discardErr := sess.state.Discard(ctx)
+		if nil != discardErr {
+			sess.config.logger.Warn("discarding state for failed commit failed", zap.Error(discardErr))
+		}
+
+		return replyDATATransactionFailed, keepSession, err
+	}
+
+	sess.state.reset()
+
+	switch action {
+	case AcceptCommit:
+		break
+
+	case RejectCommitPermanently:
+		return replyDATARejectPermanent, keepSession, err
+
+	case RejectCommitForTooManyRecipients:
+		return replyDATARejectNumberRecipients, keepSession, err
+
+	case RejectCommitTemporarilyForSizeExceeded:
+		return replyDATARejectSizeTemporary, keepSession, err
+
+	case RejectCommitPermanentlyForSizeExceeded:
+		return replyDATARejectSizePermanent, keepSession, err
+
+	default:
+		return replyDATARejectTemporary, keepSession, err
 	}
+
+	return replyAnyOk, keepSession, err
 }
 
-func (sess *Session) processCommand(ctx context.Context, line []byte) ([]byte, sessionAction, error) {
+func (sess *Session) processCommand(ctx context.Context, line []byte) (Reply, sessionAction, error) {
 	command, result := parseCommand(line)
 
 	switch result {
 	case parseBadFormat:
 		return replyAnyBadCommand, keepSession, nil
 	case parseUnrecognizedCommand:
-		return replyAnyBadCommand, keepSession, nil
+		if nil == sess.verbExtension(command.verb) {
+			return replyAnyBadCommand, keepSession, nil
+		}
+
+		command.name = commandExtension
 	}
 
+	reply, action, err := sess.dispatchCommand(ctx, command)
+	if keepSession == action && command.synchronizing() {
+		action = flushSession
+	}
+
+	return reply, action, err
+}
+
+func (sess *Session) dispatchCommand(ctx context.Context, command command) (Reply, sessionAction, error) {
 	if sess.config.tlsRequired && sess.config.tls && !sess.state.inSTARTTLS() {
 		switch command.name {
 		case commandHELO, commandEHLO:
@@ -195,6 +599,9 @@ func (sess *Session) processCommand(ctx context.Context, line []byte) ([]byte, s
 		case commandSTARTTLS:
 			return sess.processSTARTTLS(ctx, command)
 
+		case commandBDAT:
+			return sess.rejectChunk(command, replySTARTTLSRequired, nil)
+
 		default:
 			return replySTARTTLSRequired, keepSession, nil
 		}
@@ -211,10 +618,17 @@ func (sess *Session) processCommand(ctx context.Context, line []byte) ([]byte, s
 		return sess.processNOOP(ctx, command)
 	case commandSTARTTLS:
 		return sess.processSTARTTLS(ctx, command)
+	case commandAUTH:
+		return sess.processAUTH(ctx, command)
+	case commandBDAT:
+		return sess.processBDAT(ctx, command)
 
 	case commandHELO, commandEHLO:
 		return sess.processEHLO(ctx, command)
 
+	case commandExtension:
+		return sess.processExtension(ctx, command)
+
 	case commandHELP:
 		return sess.processHELP(ctx, command)
 	case commandEXPN:
@@ -240,15 +654,15 @@ func (sess *Session) processCommand(ctx context.Context, line []byte) ([]byte, s
 	return replyAnyBadSequence, keepSession, nil
 }
 
-func (sess *Session) processNOOP(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processNOOP(ctx context.Context, command command) (Reply, sessionAction, error) {
 	return replyAnyOk, keepSession, nil
 }
 
-func (sess *Session) processQUIT(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processQUIT(ctx context.Context, command command) (Reply, sessionAction, error) {
 	return replyServiceClosing(sess.config.domain), closeSession, sess.state.Discard(ctx)
 }
 
-func (sess *Session) processRSET(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processRSET(ctx context.Context, command command) (Reply, sessionAction, error) {
 	err := sess.state.Discard(ctx)
 	if nil != err {
 		sess.config.logger.Warn("discarding state for transaction reset failed", zap.Error(err))
@@ -257,9 +671,39 @@ func (sess *Session) processRSET(ctx context.Context, command command) ([]byte,
 	return replyAnyOk, keepSession, err
 }
 
-func (sess *Session) processMAIL(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processMAIL(ctx context.Context, command command) (Reply, sessionAction, error) {
 	if nil == command.addr {
-		return replyAnyBadCommand, keepSession, nil
+		return replyMAILBadSyntax, keepSession, nil
+	}
+
+	if command.badParams {
+		return replyAnyBadParams, keepSession, nil
+	}
+
+	if !sess.recognizedParams(command.params, Extension.MailParams) {
+		return replyAnyUnknownParams, keepSession, nil
+	}
+
+	if !command.utf8 && !command.path.IsASCII() {
+		return replyMAILNonASCII, keepSession, nil
+	}
+
+	if 0 != sess.config.maxMessageSize && command.sizeHint > sess.config.maxMessageSize {
+		return replyMAILRejectSIZEPermanent, keepSession, nil
+	}
+
+	auth := ""
+
+	if value, ok := command.params["AUTH"]; ok {
+		decoded, ok := decodeXtext(value)
+		if !ok {
+			return replyAnyBadParams, keepSession, nil
+		}
+
+		// the submitter is only trusted from authenticated clients, RFC 4954
+		if "" != sess.state.identity && "<>" != decoded {
+			auth = decoded
+		}
 	}
 
 	err := sess.state.Discard(ctx)
@@ -272,7 +716,34 @@ func (sess *Session) processMAIL(ctx context.Context, command command) ([]byte,
 		return replyServiceNotAvailable(sess.config.domain), closeSession, err
 	}
 
-	fromAction, err := env.From(ctx, command.addr)
+	var fromAction FromAction
+
+	if commandEnv, ok := env.(CommandEnvelope); ok {
+		fromAction, err = commandEnv.Mail(ctx, Mail{
+			From:   command.path,
+			Params: command.params,
+			Body:   command.body,
+			UTF8:   command.utf8,
+
+			Return:     command.ret,
+			EnvelopeID: command.envID,
+
+			Auth: auth,
+		})
+	} else {
+		fromAction, err = env.From(ctx, command.addr)
+	}
+
+	reply := replyMAILOk
+
+	if custom, ok := envelopeReply(err, sess.config.logger); ok {
+		if !custom.positive() {
+			return custom, keepSession, env.Discard(ctx)
+		}
+
+		reply, fromAction, err = custom, AcceptFROM, nil
+	}
+
 	if nil != err {
 		sess.config.logger.Warn("adding reverse-path failed", zap.Error(err))
 
@@ -291,6 +762,15 @@ func (sess *Session) processMAIL(ctx context.Context, command command) ([]byte,
 	}
 
 	sizeAction, err := env.Size(ctx, command.sizeHint)
+
+	if custom, ok := envelopeReply(err, sess.config.logger); ok {
+		if !custom.positive() {
+			return custom, keepSession, env.Discard(ctx)
+		}
+
+		reply, sizeAction, err = custom, AcceptSIZE, nil
+	}
+
 	if nil != err {
 		sess.config.logger.Warn("adding size-hint failed", zap.Error(err))
 
@@ -310,16 +790,56 @@ func (sess *Session) processMAIL(ctx context.Context, command command) ([]byte,
 
 	sess.state.env = env
 	sess.state.envState = envelopeCreated
+	sess.state.from = command.path
+	sess.state.body = command.body
+	sess.state.utf8 = command.utf8
 
-	return replyAnyOk, keepSession, nil
+	return reply, keepSession, nil
 }
 
-func (sess *Session) processRCPT(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processRCPT(ctx context.Context, command command) (Reply, sessionAction, error) {
 	if nil == command.addr {
-		return replyAnyBadCommand, keepSession, nil
+		return replyRCPTBadSyntax, keepSession, nil
+	}
+
+	if command.badParams {
+		return replyAnyBadParams, keepSession, nil
+	}
+
+	if !sess.recognizedParams(command.params, Extension.RcptParams) {
+		return replyAnyUnknownParams, keepSession, nil
+	}
+
+	if !sess.state.utf8 && !command.path.IsASCII() {
+		return replyRCPTNonASCII, keepSession, nil
+	}
+
+	var action ToAction
+	var err error
+
+	if commandEnv, ok := sess.state.env.(CommandEnvelope); ok {
+		action, err = commandEnv.Rcpt(ctx, Rcpt{
+			To:     command.path,
+			Params: command.params,
+
+			Notify:                command.notify,
+			OriginalRecipientType: command.orcptType,
+			OriginalRecipient:     command.orcpt,
+		})
+	} else {
+		action, err = sess.state.env.To(ctx, command.addr)
+	}
+
+	reply := replyRCPTOk
+
+	if custom, ok := envelopeReply(err, sess.config.logger); ok {
+		if !custom.positive() {
+			return custom, keepSession, nil
+		}
+
+		reply, action, err = custom, AcceptTO, nil
 	}
 
-	action, err := sess.state.env.To(ctx, command.addr)
 	if nil != err {
 		sess.config.logger.Warn("adding recipient failed", zap.Error(err))
 
@@ -338,12 +858,27 @@ func (sess *Session) processRCPT(ctx context.Context, command command) ([]byte,
 	}
 
 	sess.state.envState = envelopeRecipients
+	sess.state.recipients = append(sess.state.recipients, command.path)
 
-	return replyAnyOk, keepSession, err
+	return reply, keepSession, err
 }
 
-func (sess *Session) processDATA(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processDATA(ctx context.Context, command command) (Reply, sessionAction, error) {
+	if BodyBINARYMIME == sess.state.body {
+		// binary content cannot be dot-stuffed, RFC 3030
+		return replyDATABinaryMIME, keepSession, nil
+	}
+
 	action, err := sess.state.env.Open(ctx)
+
+	if reply, ok := envelopeReply(err, sess.config.logger); ok {
+		if !reply.positive() {
+			return reply, keepSession, sess.state.Discard(ctx)
+		}
+
+		action, err = AcceptDATA, nil
+	}
+
 	if nil != err {
 		sess.config.logger.Warn("open failed", zap.Error(err))
 		return replyDATATransactionFailed, keepSession, sess.state.Discard(ctx)
@@ -358,22 +893,161 @@ func (sess *Session) processDATA(ctx context.Context, command command) ([]byte,
 	}
 
 	sess.state.envState = envelopeData
+	sess.state.startContent(ctx)
+
+	err = sess.writeTraceHeaders(ctx)
+	if nil != err {
+		sess.config.logger.Warn("adding trace headers to envelope failed", zap.Error(err))
+
+		return replyServiceNotAvailable(sess.config.domain), closeSession, err
+	}
+
+	return replyDATAContinue, keepSession, nil
+}
+
+func (sess *Session) processBDAT(ctx context.Context, command command) (Reply, sessionAction, error) {
+	if command.badParams {
+		// the size of the chunk is unknown, so its octets are read as commands
+		return replyAnyBadParams, keepSession, nil
+	}
+
+	if sess.state.inRCPT() {
+		action, err := sess.state.env.Open(ctx)
+
+		if reply, ok := envelopeReply(err, sess.config.logger); ok {
+			if !reply.positive() {
+				return sess.rejectChunk(command, reply, sess.state.Discard(ctx))
+			}
+
+			action, err = AcceptDATA, nil
+		}
+
+		if nil != err {
+			sess.config.logger.Warn("open failed", zap.Error(err))
+			return sess.rejectChunk(command, replyDATATransactionFailed, sess.state.Discard(ctx))
+		}
+
+		switch action {
+		case AcceptDATA:
+			break
+
+		default:
+			return sess.rejectChunk(command, replyDATATransactionFailed, sess.state.Discard(ctx))
+		}
+
+		sess.state.envState = envelopeChunks
+		sess.state.startContent(ctx)
+
+		err = sess.writeTraceHeaders(ctx)
+		if nil != err {
+			sess.config.logger.Warn("adding trace headers to envelope failed", zap.Error(err))
+
+			return replyServiceNotAvailable(sess.config.domain), closeSession, err
+		}
+	} else if !sess.state.inBDAT() {
+		return sess.rejectChunk(command, replyAnyBadSequence, nil)
+	}
+
+	if sess.exceedsMaxMessageSize(command.chunkSize) {
+		return sess.rejectChunk(command, replyDATARejectSizePermanent, sess.state.Discard(ctx))
+	}
+
+	sess.state.chunkSize = command.chunkSize
+	sess.state.chunkLast = command.last
+	sess.state.chunkReply = Reply{}
+
+	if 0 == command.chunkSize {
+		return sess.finishChunk(ctx)
+	}
+
+	return Reply{}, keepSession, nil
+}
+
+// Rejects a BDAT command with the reply, which is only sent once the octets
+// of its chunk have been read and discarded, RFC 3030.
+func (sess *Session) rejectChunk(command command, reply Reply, err error) (Reply, sessionAction, error) {
+	if 0 == command.chunkSize {
+		return reply, keepSession, err
+	}
 
-	return replyDATAContinue, keepSession, err
+	sess.state.chunkSize = command.chunkSize
+	sess.state.chunkLast = false
+	sess.state.chunkReply = reply
+
+	return Reply{}, keepSession, err
+}
+
+// Whether the octets of a BDAT chunk are expected instead of lines.
+func (sess *Session) chunkPending() bool {
+	return 0 < sess.state.chunkSize
 }
 
-func (sess *Session) processSTARTTLS(ctx context.Context, command command) ([]byte, sessionAction, error) {
+// Advance the session with octets of the pending BDAT chunk, which must not
+// be more than remain in the chunk.
+func (sess *Session) advanceChunk(ctx context.Context, chunk []byte) (Reply, sessionAction, error) {
+	sess.state.chunkSize -= uint64(len(chunk))
+
+	if 0 == sess.state.chunkReply.Code {
+		sess.state.dataSize += uint64(len(chunk))
+
+		err := sess.writeEnvelope(ctx, chunk)
+		if nil != err {
+			sess.config.logger.Warn("adding chunk to envelope failed", zap.Error(err))
+
+			return replyServiceNotAvailable(sess.config.domain), closeSession, err
+		}
+
+		if reply := sess.advanceHeader(ctx, chunk); 0 != reply.Code {
+			err = sess.state.Discard(ctx)
+			if !sess.chunkPending() {
+				return reply, keepSession, err
+			}
+
+			// the rest of the chunk is read but discarded, RFC 3030
+			sess.state.chunkLast = false
+			sess.state.chunkReply = reply
+
+			return Reply{}, keepSession, err
+		}
+	}
+
+	if sess.chunkPending() {
+		return Reply{}, keepSession, nil
+	}
+
+	return sess.finishChunk(ctx)
+}
+
+func (sess *Session) finishChunk(ctx context.Context) (Reply, sessionAction, error) {
+	if 0 != sess.state.chunkReply.Code {
+		reply := sess.state.chunkReply
+		sess.state.chunkReply = Reply{}
+
+		return reply, keepSession, nil
+	}
+
+	if sess.state.chunkLast {
+		sess.state.chunkLast = false
+
+		return sess.commit(ctx)
+	}
+
+	return replyBDATOk(sess.state.dataSize), keepSession, nil
+}
+
+func (sess *Session) processSTARTTLS(ctx context.Context, command command) (Reply, sessionAction, error) {
 	if sess.state.tls || !sess.config.tls {
 		return replyAnyNotImplemented, keepSession, nil
 	}
 
 	sess.state.domain = nil
 	sess.state.tls = true
+	sess.state.identity = ""
 
 	return replySTARTTLSReady, upgradeSession, sess.state.Discard(ctx)
 }
 
-func (sess *Session) processEHLO(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processEHLO(ctx context.Context, command command) (Reply, sessionAction, error) {
 	if nil == command.addr {
 		return replyAnyBadCommand, keepSession, nil
 	}
@@ -381,28 +1055,34 @@ func (sess *Session) processEHLO(ctx context.Context, command command) ([]byte,
 	err := sess.state.Discard(ctx)
 
 	sess.state.domain = command.addr
+	sess.state.extended = commandEHLO == command.name
 
 	if commandHELO == command.name {
-		return replyEHLOOk(sess.config.domain, ""), keepSession, err
+		return replyEHLOOk(sess.config.domain, nil), keepSession, err
 	}
 
-	extensions := extensionsTLS
+	return replyEHLOOk(sess.config.domain, sess.advertisedExtensions()), keepSession, err
+}
 
-	if sess.state.tls || !sess.config.tls {
-		extensions = extensionsNoTLS
+func (sess *Session) processExtension(ctx context.Context, command command) (Reply, sessionAction, error) {
+	reply, err := sess.verbExtension(command.verb).Command(ctx, sess, command.verb, string(command.args))
+	if nil != err {
+		sess.config.logger.Warn("extension command failed", zap.String("verb", command.verb), zap.Error(err))
+
+		return replyServiceNotAvailable(sess.config.domain), closeSession, sess.state.Discard(ctx)
 	}
 
-	return replyEHLOOk(sess.config.domain, extensions), keepSession, err
+	return reply, keepSession, nil
 }
 
-func (sess *Session) processHELP(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processHELP(ctx context.Context, command command) (Reply, sessionAction, error) {
 	return replyAnyNotImplemented, keepSession, nil
 }
 
-func (sess *Session) processEXPN(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processEXPN(ctx context.Context, command command) (Reply, sessionAction, error) {
 	return replyAnyNotImplemented, keepSession, nil
 }
 
-func (sess *Session) processVRFY(ctx context.Context, command command) ([]byte, sessionAction, error) {
+func (sess *Session) processVRFY(ctx context.Context, command command) (Reply, sessionAction, error) {
 	return replyAnyNotImplemented, keepSession, nil
 }
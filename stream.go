@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// An Envelope can optionally implement StreamEnvelope to receive the content
+// of messages as a stream, instead of in pieces with Write which is then not
+// called.
+type StreamEnvelope interface {
+	Envelope
+
+	// Read the content of the message, dot-unstuffed if sent with DATA, which
+	// ends with io.EOF after the final dot or the last BDAT chunk. Called in
+	// its own goroutine once Open accepts the data, and the client is not
+	// read from until the content read so far is consumed. Only content
+	// within Config.MaxMessageSize is streamed.
+	//
+	// Returning an error rejects the message once its end has been read, with
+	// the error if it is a Reply. Returning nil before the end discards the
+	// rest of the content. Reads fail with ErrContentAborted if the
+	// transaction ends without the content being committed, and Commit or
+	// Discard are only called once Data has returned. The context is
+	// cancelled if the session is killed or the server forcefully shut down,
+	// after which the session no longer waits for Data.
+	Data(ctx context.Context, r io.Reader) error
+}
+
+// Returned by reads of the content of a StreamEnvelope if the transaction ends
+// before the end of the content.
+var ErrContentAborted = errors.New("smtp: content aborted")
+
+// The content of a message streamed to a StreamEnvelope.
+type contentStream struct {
+	writer *io.PipeWriter
+	done   chan error
+
+	// the context of Data, which is cancelled when the session is killed or
+	// the server forcefully shut down, after which Data is not waited for
+	ctx context.Context
+
+	// whether Data has returned, and its error
+	returned bool
+	err      error
+
+	// whether writes failed as Data has returned or was stopped, so that the
+	// rest is discarded
+	finished bool
+}
+
+func startContentStream(ctx context.Context, env StreamEnvelope) *contentStream {
+	reader, writer := io.Pipe()
+
+	stream := &contentStream{
+		writer: writer,
+		done:   make(chan error, 1),
+		ctx:    ctx,
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		err := env.Data(ctx, reader)
+		close(stopped)
+
+		// the writes of content that was not read fail instead of blocking
+		reader.Close()
+
+		stream.done <- err
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// pending writes fail, so that a Data which stopped reading
+			// does not block the session
+			reader.CloseWithError(ErrContentAborted)
+
+		case <-stopped:
+		}
+	}()
+
+	return stream
+}
+
+// Writes content to the stream, blocking until Data has read it.
+func (stream *contentStream) write(content []byte) {
+	if stream.finished {
+		return
+	}
+
+	_, err := stream.writer.Write(content)
+	if nil != err {
+		stream.finished = true
+	}
+}
+
+// Waits for Data to return, unless its context is done first, returning
+// whether it has.
+func (stream *contentStream) wait() bool {
+	if stream.returned {
+		return true
+	}
+
+	select {
+	case stream.err = <-stream.done:
+		stream.returned = true
+
+	case <-stream.ctx.Done():
+	}
+
+	return stream.returned
+}
+
+// Ends the content, returning the error of Data, or that of its context if
+// Data has not returned.
+func (stream *contentStream) close() error {
+	stream.writer.Close()
+
+	if !stream.wait() {
+		return stream.ctx.Err()
+	}
+
+	return stream.err
+}
+
+// Aborts the content, returning whether Data has returned.
+func (stream *contentStream) abort() bool {
+	stream.writer.CloseWithError(ErrContentAborted)
+
+	return stream.wait()
+}
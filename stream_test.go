@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	tst "testing"
+	"time"
+)
+
+type testStreamEnvelope struct {
+	testEnvelope
+
+	content []byte
+	readErr error
+
+	dataCalls int
+
+	onData func(ctx context.Context, env *testStreamEnvelope, r io.Reader) error
+}
+
+func (env *testStreamEnvelope) Data(ctx context.Context, r io.Reader) error {
+	env.dataCalls += 1
+
+	if nil != env.onData {
+		return env.onData(ctx, env, r)
+	}
+
+	env.content, env.readErr = ioutil.ReadAll(r)
+
+	return env.readErr
+}
+
+func TestContentStream(t *tst.T) {
+	env := &testStreamEnvelope{}
+
+	stream := startContentStream(context.Background(), env)
+	stream.write([]byte("hello\r\n"))
+	stream.write([]byte("world\r\n"))
+
+	if err := stream.close(); nil != err {
+		t.Errorf("Unexpected close error: %v", err)
+	}
+
+	if "hello\r\nworld\r\n" != string(env.content) {
+		t.Errorf("Unexpected content: %q", env.content)
+	}
+}
+
+func TestContentStreamFinished(t *tst.T) {
+	env := &testStreamEnvelope{
+		onData: func(ctx context.Context, env *testStreamEnvelope, r io.Reader) error {
+			env.content = make([]byte, 3)
+			_, err := io.ReadFull(r, env.content)
+
+			return err
+		},
+	}
+
+	stream := startContentStream(context.Background(), env)
+
+	// the writes after Data has returned must not block
+	stream.write([]byte("hello\r\n"))
+	stream.write([]byte("world\r\n"))
+
+	if err := stream.close(); nil != err {
+		t.Errorf("Unexpected close error: %v", err)
+	}
+
+	if "hel" != string(env.content) {
+		t.Errorf("Unexpected content: %q", env.content)
+	}
+}
+
+func TestContentStreamAbort(t *tst.T) {
+	env := &testStreamEnvelope{}
+
+	stream := startContentStream(context.Background(), env)
+	stream.write([]byte("hello\r\n"))
+
+	if !stream.abort() || ErrContentAborted != stream.err {
+		t.Errorf("Unexpected abort error: %v", stream.err)
+	}
+
+	if "hello\r\n" != string(env.content) {
+		t.Errorf("Unexpected content: %q", env.content)
+	}
+}
+
+func TestContentStreamCancel(t *tst.T) {
+	release := make(chan struct{})
+
+	env := &testStreamEnvelope{
+		onData: func(ctx context.Context, env *testStreamEnvelope, r io.Reader) error {
+			// never reads the content
+			<-release
+
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := startContentStream(ctx, env)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	// the write blocks until the context is cancelled
+	stream.write([]byte("hello\r\n"))
+
+	if !stream.finished {
+		t.Errorf("Write did not fail once the context was cancelled")
+	}
+
+	if stream.abort() {
+		t.Errorf("Unexpected return of Data")
+	}
+
+	if err := stream.close(); context.Canceled != err {
+		t.Errorf("Unexpected close error: %v", err)
+	}
+
+	close(release)
+
+	if err := <-stream.done; nil != err {
+		t.Errorf("Unexpected Data error: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"time"
+)
+
+// Timeouts for each phase of the SMTP dialog, as recommended by RFC 5321
+// section 4.5.3.2. A zero value uses the RFC default, while a negative value
+// disables the timeout. When a timeout expires, the client is sent a 421
+// reply and the connection is closed.
+type Timeouts struct {
+	// Time allowed for the (implicit) TLS handshake, sending the greeting and
+	// receiving the first command. Defaults to 5 minutes.
+	Greeting time.Duration
+
+	// Time allowed for receiving a command outside of a mail transaction.
+	// Defaults to 5 minutes.
+	Command time.Duration
+
+	// Time allowed for receiving the command following a MAIL command.
+	// Defaults to 5 minutes.
+	MAIL time.Duration
+
+	// Time allowed for receiving the command following a RCPT command.
+	// Defaults to 5 minutes.
+	RCPT time.Duration
+
+	// Time allowed for receiving the first data after the 354 reply to DATA.
+	// Defaults to 2 minutes.
+	DATAInitiation time.Duration
+
+	// Time allowed between receiving data blocks. Defaults to 3 minutes.
+	DATABlock time.Duration
+
+	// Time allowed for committing the envelope after receiving the final dot.
+	// This is enforced on the context passed to Envelope.Commit. Defaults to
+	// 10 minutes.
+	DATATermination time.Duration
+}
+
+func (timeouts Timeouts) withDefaults() Timeouts {
+	defaults := func(timeout *time.Duration, value time.Duration) {
+		if 0 == *timeout {
+			*timeout = value
+		}
+	}
+
+	defaults(&timeouts.Greeting, 5*time.Minute)
+	defaults(&timeouts.Command, 5*time.Minute)
+	defaults(&timeouts.MAIL, 5*time.Minute)
+	defaults(&timeouts.RCPT, 5*time.Minute)
+	defaults(&timeouts.DATAInitiation, 2*time.Minute)
+	defaults(&timeouts.DATABlock, 3*time.Minute)
+	defaults(&timeouts.DATATermination, 10*time.Minute)
+
+	return timeouts
+}
+
+func (timeouts Timeouts) forPhase(phase sessionPhase) time.Duration {
+	switch phase {
+	case phaseGreeting:
+		return timeouts.Greeting
+	case phaseMAIL:
+		return timeouts.MAIL
+	case phaseRCPT:
+		return timeouts.RCPT
+	case phaseDATAInitiation:
+		return timeouts.DATAInitiation
+	case phaseDATABlock:
+		return timeouts.DATABlock
+	}
+
+	return timeouts.Command
+}
+
+// Deadline for the provided timeout from now, or the zero time if the
+// timeout is disabled.
+func deadline(timeout time.Duration) time.Time {
+	if timeout < 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	tst "testing"
+	"time"
+)
+
+func TestTimeoutsWithDefaults(t *tst.T) {
+	timeouts := Timeouts{
+		Command:   time.Second,
+		DATABlock: -1,
+	}.withDefaults()
+
+	expected := map[sessionPhase]time.Duration{
+		phaseGreeting:       5 * time.Minute,
+		phaseCommand:        time.Second,
+		phaseMAIL:           5 * time.Minute,
+		phaseRCPT:           5 * time.Minute,
+		phaseDATAInitiation: 2 * time.Minute,
+		phaseDATABlock:      -1,
+	}
+
+	for phase, timeout := range expected {
+		if timeout != timeouts.forPhase(phase) {
+			t.Errorf("Unexpected timeout for phase %v: %v", phaseNames[phase], timeouts.forPhase(phase))
+		}
+	}
+
+	if 10*time.Minute != timeouts.DATATermination {
+		t.Errorf("Unexpected DATATermination timeout: %v", timeouts.DATATermination)
+	}
+}
+
+func TestDeadline(t *tst.T) {
+	if !deadline(-1).IsZero() {
+		t.Errorf("Negative timeout did not disable deadline")
+	}
+
+	if !deadline(time.Minute).After(time.Now()) {
+		t.Errorf("Deadline is not in the future")
+	}
+}
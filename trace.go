@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
+
+// The address-literal of the IP address in a host:port address, or the empty
+// string if there is none.
+func addressLiteral(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if nil != err {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+
+	if nil == ip {
+		return ""
+	}
+
+	if nil != ip.To4() {
+		return "[" + ip.String() + "]"
+	}
+
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// The domain or address-literal sent with HELO or EHLO for the from clause of
+// the Received header, RFC 5321 section 4.4. An argument of any other syntax
+// is not trusted into the header as is, but quoted in a comment with the
+// octets that cannot appear in one replaced.
+func traceDomain(domain []byte) string {
+	if 0 != len(domain) && isASCII(string(domain)) {
+		if '[' == domain[0] && len(domain) == scanAddressLiteral(domain) {
+			return string(domain)
+		}
+
+		if len(domain) == scanDomain(domain) {
+			return string(domain)
+		}
+	}
+
+	var builder strings.Builder
+
+	builder.WriteString("unknown (helo=")
+
+	for _, c := range domain {
+		switch {
+		case '(' == c || ')' == c || '\\' == c:
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+
+		case c <= ' ' || c >= 0x7f:
+			builder.WriteByte('?')
+
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	builder.WriteString(")")
+
+	return builder.String()
+}
+
+// The protocol of the session for the WITH clause of the Received header, RFC
+// 3848 and RFC 6531.
+func (sess *Session) traceProtocol() string {
+	if !sess.state.extended {
+		return "SMTP"
+	}
+
+	protocol := "ESMTP"
+
+	if sess.state.utf8 {
+		protocol = "UTF8SMTP"
+	}
+
+	if sess.state.tls {
+		protocol += "S"
+	}
+
+	if "" != sess.state.identity {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+// Lines of the trace headers enabled in the config for the transaction, RFC
+// 5321 section 4.4. The for clause is only added with a single recipient, so
+// that other recipients are not disclosed.
+func (sess *Session) traceHeaders(now time.Time) []string {
+	lines := make([]string, 0, 5)
+
+	if sess.config.returnPathHeader {
+		lines = append(lines, "Return-Path: <"+sess.state.from.String()+">\r\n")
+	}
+
+	if !sess.config.receivedHeader {
+		return lines
+	}
+
+	from := "Received: from " + traceDomain(sess.state.domain)
+
+	if literal := addressLiteral(sess.Addr); "" != literal {
+		from += " (" + literal + ")"
+	}
+
+	lines = append(lines, from+"\r\n")
+
+	if nil != sess.state.tlsState {
+		lines = append(lines, "\t(using "+tlsVersionName(sess.state.tlsState.Version)+" with cipher "+tls.CipherSuiteName(sess.state.tlsState.CipherSuite)+")\r\n")
+	}
+
+	by := "\tby " + sess.config.domain + " with " + sess.traceProtocol() + " id " + sess.ID
+
+	if 1 == len(sess.state.recipients) {
+		lines = append(lines, by+"\r\n")
+		by = "\tfor <" + sess.state.recipients[0].String() + ">"
+	}
+
+	lines = append(lines, by+"; "+now.Format(time.RFC1123Z)+"\r\n")
+
+	return lines
+}
+
+// Writes the trace headers before the content of the message.
+func (sess *Session) writeTraceHeaders(ctx context.Context) error {
+	for _, line := range sess.traceHeaders(time.Now()) {
+		err := sess.writeEnvelope(ctx, []byte(line))
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
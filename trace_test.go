@@ -0,0 +1,143 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"reflect"
+	tst "testing"
+	"time"
+)
+
+func TestAddressLiteral(t *tst.T) {
+	examples := map[string]string{
+		"192.0.2.1:25":       "[192.0.2.1]",
+		"[2001:db8::1]:25":   "[IPv6:2001:db8::1]",
+		"192.0.2.1":          "[192.0.2.1]",
+		"pipe":               "",
+		"example.com:25":     "",
+		"[::ffff:1.2.3.4]:1": "[1.2.3.4]",
+	}
+
+	for addr, expected := range examples {
+		if literal := addressLiteral(addr); expected != literal {
+			t.Errorf("Unexpected address-literal for %q: %q", addr, literal)
+		}
+	}
+}
+
+func TestTraceProtocol(t *tst.T) {
+	examples := []struct {
+		State    sessionState
+		Expected string
+	}{
+		{sessionState{}, "SMTP"},
+		{sessionState{extended: true}, "ESMTP"},
+		{sessionState{extended: true, tls: true}, "ESMTPS"},
+		{sessionState{extended: true, identity: "someone"}, "ESMTPA"},
+		{sessionState{extended: true, tls: true, identity: "someone"}, "ESMTPSA"},
+		{sessionState{extended: true, tls: true, utf8: true}, "UTF8SMTPS"},
+	}
+
+	for _, ex := range examples {
+		sess := &Session{state: ex.State}
+
+		if protocol := sess.traceProtocol(); ex.Expected != protocol {
+			t.Errorf("Unexpected protocol for %v: %v", ex.Expected, protocol)
+		}
+	}
+}
+
+func TestTraceDomain(t *tst.T) {
+	examples := map[string]string{
+		"domain.com":         "domain.com",
+		"mail-1.domain.com":  "mail-1.domain.com",
+		"[192.0.2.1]":        "[192.0.2.1]",
+		"[IPv6:2001:db8::1]": "[IPv6:2001:db8::1]",
+		"":                   "unknown (helo=)",
+		"-domain.com":        "unknown (helo=-domain.com)",
+		"a;b":                "unknown (helo=a;b)",
+		"x)\r\nBcc:(y":       "unknown (helo=x\\)??Bcc:\\(y)",
+		"d\\(o)main":         "unknown (helo=d\\\\\\(o\\)main)",
+		"b\xc3\xbccher.de":   "unknown (helo=b??cher.de)",
+		"[192.0.2.1":         "unknown (helo=[192.0.2.1)",
+	}
+
+	for domain, expected := range examples {
+		if result := traceDomain([]byte(domain)); expected != result {
+			t.Errorf("Unexpected trace domain for %q: %q", domain, result)
+		}
+	}
+}
+
+func TestTraceHeaders(t *tst.T) {
+	now := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+
+	examples := []struct {
+		Session  Session
+		Expected []string
+	}{
+		{
+			Session: Session{
+				ID:   "abc",
+				Addr: "192.0.2.1:4321",
+				config: sessionConfig{
+					domain:           "example.com",
+					receivedHeader:   true,
+					returnPathHeader: true,
+				},
+				state: sessionState{
+					domain:   []byte("client.example.org"),
+					extended: true,
+					tls:      true,
+					tlsState: &tls.ConnectionState{
+						Version:     tls.VersionTLS13,
+						CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+					},
+					identity:   "someone",
+					from:       Path{LocalPart: "someone", Domain: "domain.com"},
+					recipients: []Path{{LocalPart: "other", Domain: "example.com"}},
+				},
+			},
+			Expected: []string{
+				"Return-Path: <someone@domain.com>\r\n",
+				"Received: from client.example.org ([192.0.2.1])\r\n",
+				"\t(using TLSv1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n",
+				"\tby example.com with ESMTPSA id abc\r\n",
+				"\tfor <other@example.com>; Sat, 17 Oct 2026 10:00:00 +0000\r\n",
+			},
+		},
+		{
+			Session: Session{
+				ID:   "abc",
+				Addr: "[2001:db8::1]:4321",
+				config: sessionConfig{
+					domain:         "example.com",
+					receivedHeader: true,
+				},
+				state: sessionState{
+					domain:     []byte("client.example.org"),
+					recipients: []Path{{LocalPart: "one", Domain: "example.com"}, {LocalPart: "two", Domain: "example.com"}},
+				},
+			},
+			Expected: []string{
+				"Received: from client.example.org ([IPv6:2001:db8::1])\r\n",
+				"\tby example.com with SMTP id abc; Sat, 17 Oct 2026 10:00:00 +0000\r\n",
+			},
+		},
+		{
+			Session: Session{
+				config: sessionConfig{
+					returnPathHeader: true,
+				},
+			},
+			Expected: []string{
+				"Return-Path: <>\r\n",
+			},
+		},
+	}
+
+	for i, ex := range examples {
+		if lines := ex.Session.traceHeaders(now); !reflect.DeepEqual(ex.Expected, lines) {
+			t.Errorf("Unexpected trace headers for example %v: %q", i, lines)
+		}
+	}
+}